@@ -0,0 +1,285 @@
+package client
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Target is a server a client may call: the URL of its call endpoint and,
+// for the weighted balancer, its share of the traffic.
+type Target struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"` // values below 1 count as 1
+}
+
+// Endpoint is the client's state for one Target: the calls outstanding on it
+// and whether it has been ejected for failing.
+type Endpoint struct {
+	url         string
+	weight      int
+	outstanding int64
+	current     int // smooth weighted round-robin state, guarded by its balancer
+
+	mu           sync.Mutex
+	failures     int // consecutive, reset by a success or an ejection
+	ejectedUntil time.Time
+}
+
+func newEndpoint(target Target) *Endpoint {
+	weight := target.Weight
+	if weight < 1 {
+		weight = 1
+	}
+	return &Endpoint{url: target.URL, weight: weight}
+}
+
+func (e *Endpoint) URL() string { return e.url }
+
+func (e *Endpoint) Weight() int { return e.weight }
+
+// Outstanding returns the number of calls sent to the endpoint and not yet answered.
+func (e *Endpoint) Outstanding() int {
+	return int(atomic.LoadInt64(&e.outstanding))
+}
+
+// Healthy reports whether the endpoint is taking calls, that is it isn't
+// serving an ejection.
+func (e *Endpoint) Healthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !time.Now().Before(e.ejectedUntil)
+}
+
+func (e *Endpoint) begin() {
+	atomic.AddInt64(&e.outstanding, 1)
+}
+
+// end records the outcome of a call. failed calls count towards ejecting the
+// endpoint for ejection once threshold of them happen in a row.
+func (e *Endpoint) end(failed bool, threshold int, ejection time.Duration) {
+	atomic.AddInt64(&e.outstanding, -1)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !failed {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if threshold > 0 && e.failures >= threshold {
+		e.failures = 0
+		e.ejectedUntil = time.Now().Add(ejection)
+	}
+}
+
+// PickInfo is what a Balancer knows about the call it places.
+type PickInfo struct {
+	ServiceMethod string
+	Args          interface{}
+	Metadata      map[string]string
+}
+
+// Balancer chooses the endpoint each attempt of a call goes to. Pick gets the
+// healthy endpoints, or all of them when none is healthy, never an empty
+// slice, and is called concurrently.
+type Balancer interface {
+	Pick(endpoints []*Endpoint, info PickInfo) *Endpoint
+}
+
+// BalancerFunc adapts a stateless function to Balancer.
+type BalancerFunc func(endpoints []*Endpoint, info PickInfo) *Endpoint
+
+func (f BalancerFunc) Pick(endpoints []*Endpoint, info PickInfo) *Endpoint {
+	return f(endpoints, info)
+}
+
+// Random picks an endpoint uniformly at random.
+func Random() Balancer {
+	return BalancerFunc(func(endpoints []*Endpoint, info PickInfo) *Endpoint {
+		return endpoints[rand.Intn(len(endpoints))]
+	})
+}
+
+// RoundRobin picks the endpoints in turn. It is the default balancer.
+func RoundRobin() Balancer {
+	var next uint64
+	return BalancerFunc(func(endpoints []*Endpoint, info PickInfo) *Endpoint {
+		n := atomic.AddUint64(&next, 1) - 1
+		return endpoints[n%uint64(len(endpoints))]
+	})
+}
+
+// LeastOutstanding picks the endpoint with the fewest calls in flight,
+// breaking ties at random so idle endpoints share the load.
+func LeastOutstanding() Balancer {
+	return BalancerFunc(func(endpoints []*Endpoint, info PickInfo) *Endpoint {
+		var best *Endpoint
+		least, ties := 0, 0
+		for _, e := range endpoints {
+			n := e.Outstanding()
+			switch {
+			case best == nil || n < least:
+				best, least, ties = e, n, 1
+			case n == least:
+				// reservoir sampling keeps every tied endpoint equally likely
+				ties++
+				if rand.Intn(ties) == 0 {
+					best = e
+				}
+			}
+		}
+		return best
+	})
+}
+
+// WeightedRoundRobin spreads calls in proportion to the endpoints' weights,
+// interleaving them smoothly as nginx does rather than in bursts.
+func WeightedRoundRobin() Balancer {
+	return &weightedRoundRobin{}
+}
+
+// weightedRoundRobin keeps its state on the endpoints, so that it goes away
+// with the endpoints discovery drops.
+type weightedRoundRobin struct {
+	mu sync.Mutex
+}
+
+func (b *weightedRoundRobin) Pick(endpoints []*Endpoint, info PickInfo) *Endpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *Endpoint
+	total := 0
+	for _, e := range endpoints {
+		e.current += e.weight
+		total += e.weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// KeyFunc extracts the key a call is hashed on.
+type KeyFunc func(info PickInfo) string
+
+// MetadataKey hashes calls on the metadata value under key.
+func MetadataKey(key string) KeyFunc {
+	return func(info PickInfo) string { return info.Metadata[key] }
+}
+
+// ArgsField hashes calls on a field of their args, found by its JSON name or
+// Go name in structs and by key in maps.
+func ArgsField(name string) KeyFunc {
+	return func(info PickInfo) string {
+		v := reflect.ValueOf(info.Args)
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return ""
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return ""
+			}
+			v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		case reflect.Struct:
+			v = structField(v, name)
+		default:
+			return ""
+		}
+		if !v.IsValid() {
+			return ""
+		}
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+func structField(v reflect.Value, name string) reflect.Value {
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == name || (jsonName == "" && field.Name == name) {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// virtualNodes is how many points each unit of weight puts on the ring.
+const virtualNodes = 100
+
+// ConsistentHash sends calls with the same key to the same endpoint, and
+// moves only the keys of an endpoint that leaves or joins. Calls without a
+// key are spread at random.
+func ConsistentHash(key KeyFunc) Balancer {
+	return &consistentHash{key: key}
+}
+
+type consistentHash struct {
+	key KeyFunc
+
+	mu        sync.Mutex
+	signature string // the endpoints the ring was built for
+	ring      []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint32
+	endpoint *Endpoint
+}
+
+func (b *consistentHash) Pick(endpoints []*Endpoint, info PickInfo) *Endpoint {
+	key := b.key(info)
+	if key == "" {
+		return endpoints[rand.Intn(len(endpoints))]
+	}
+	ring := b.ringFor(endpoints)
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].endpoint
+}
+
+// ringFor returns the ring for endpoints, rebuilding it only when the set
+// changed since the last pick.
+func (b *consistentHash) ringFor(endpoints []*Endpoint) []ringPoint {
+	var sb strings.Builder
+	for _, e := range endpoints {
+		sb.WriteString(e.url)
+		sb.WriteByte('*')
+		sb.WriteString(strconv.Itoa(e.weight))
+		sb.WriteByte(' ')
+	}
+	signature := sb.String()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if signature == b.signature {
+		return b.ring
+	}
+	ring := make([]ringPoint, 0, len(endpoints)*virtualNodes)
+	for _, e := range endpoints {
+		for i := 0; i < e.weight*virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(e.url + "#" + strconv.Itoa(i)))
+			ring = append(ring, ringPoint{hash: hash, endpoint: e})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	b.signature, b.ring = signature, ring
+	return ring
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newReplicas starts n servers answering every call with their index.
+func newReplicas(t *testing.T, n int) []Target {
+	targets := make([]Target, n)
+	for i := range targets {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"result":%d}`, i)
+		}))
+		t.Cleanup(ts.Close)
+		targets[i] = Target{URL: ts.URL}
+	}
+	return targets
+}
+
+func countReplies(client *Client, calls int, args interface{}) map[int]int {
+	counts := make(map[int]int)
+	for i := 0; i < calls; i++ {
+		var replica int
+		err := client.Call("Math.Add", args, &replica)
+		_assert(err == nil, "call failed: %v", err)
+		counts[replica]++
+	}
+	return counts
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	client := NewBalancedClient(newReplicas(t, 3))
+	counts := countReplies(client, 30, nil)
+	_assert(counts[0] == 10 && counts[1] == 10 && counts[2] == 10, "uneven spread %v", counts)
+}
+
+func TestBalancer_WeightedRoundRobin(t *testing.T) {
+	targets := newReplicas(t, 2)
+	targets[1].Weight = 3
+	client := NewBalancedClient(targets, WithBalancer(WeightedRoundRobin()))
+	counts := countReplies(client, 40, nil)
+	_assert(counts[0] == 10 && counts[1] == 30, "spread %v doesn't follow the weights", counts)
+}
+
+func TestBalancer_LeastOutstanding(t *testing.T) {
+	endpoints := []*Endpoint{newEndpoint(Target{URL: "a"}), newEndpoint(Target{URL: "b"}), newEndpoint(Target{URL: "c"})}
+	endpoints[0].begin()
+	endpoints[0].begin()
+	endpoints[2].begin()
+	picked := LeastOutstanding().Pick(endpoints, PickInfo{})
+	_assert(picked == endpoints[1], "expect the idle endpoint, but got %s", picked.URL())
+}
+
+func TestBalancer_ConsistentHash(t *testing.T) {
+	type Args struct {
+		UserID string `json:"user_id"`
+	}
+	var endpoints []*Endpoint
+	for _, url := range []string{"a", "b", "c", "d"} {
+		endpoints = append(endpoints, newEndpoint(Target{URL: url}))
+	}
+	balancer := ConsistentHash(ArgsField("user_id"))
+	before := make(map[string]*Endpoint)
+	for i := 0; i < 1000; i++ {
+		args := Args{UserID: fmt.Sprint("user-", i)}
+		before[args.UserID] = balancer.Pick(endpoints, PickInfo{Args: &args})
+		again := balancer.Pick(endpoints, PickInfo{Args: map[string]interface{}{"user_id": args.UserID}})
+		_assert(again == before[args.UserID], "%s moved between picks", args.UserID)
+	}
+	// dropping an endpoint only moves the keys it owned
+	for key, e := range before {
+		after := balancer.Pick(endpoints[1:], PickInfo{Args: Args{UserID: key}})
+		_assert(e == endpoints[0] || after == e, "%s moved from %s to %s", key, e.URL(), after.URL())
+	}
+
+	byMetadata := ConsistentHash(MetadataKey("tenant"))
+	info := PickInfo{Metadata: map[string]string{"tenant": "acme"}}
+	_assert(byMetadata.Pick(endpoints, info) == byMetadata.Pick(endpoints, info), "metadata key should pin the tenant")
+}
+
+func TestBalancer_EjectsUnhealthyEndpoints(t *testing.T) {
+	targets := newReplicas(t, 2)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	targets = append(targets, Target{URL: dead.URL})
+	client := NewBalancedClient(targets, WithEjection(2, time.Minute))
+
+	failures := 0
+	for i := 0; i < 30; i++ {
+		if client.Call("Math.Add", nil, nil) != nil {
+			failures++
+		}
+	}
+	_assert(failures == 2, "expect 2 failures before the ejection, but got %d", failures)
+	for _, e := range client.Endpoints() {
+		_assert(e.Healthy() == (e.URL() != dead.URL), "wrong health for %s", e.URL())
+		_assert(e.Outstanding() == 0, "%s still has %d calls outstanding", e.URL(), e.Outstanding())
+	}
+}
+
+func TestBalancer_EjectsEndpointsThatTimeOut(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body) // the server notices a cancelled call only once the body is read
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	client := NewBalancedClient([]Target{{URL: hung.URL}}, WithEjection(2, time.Minute))
+
+	// the caller giving up says nothing about the endpoint
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	for i := 0; i < 2; i++ {
+		_assert(client.CallContext(ctx, "Math.Add", nil, nil) != nil, "cancelled call should fail")
+	}
+	_assert(client.Endpoints()[0].Healthy(), "cancelled calls should not eject the endpoint")
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_assert(client.CallContext(ctx, "Math.Add", nil, nil) != nil, "call should time out")
+		cancel()
+	}
+	_assert(!client.Endpoints()[0].Healthy(), "an endpoint missing deadlines should be ejected")
+}
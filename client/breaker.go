@@ -0,0 +1,324 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"rpcsimple/status"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets calls through and watches them fail.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails calls fast without sending them.
+	BreakerOpen
+	// BreakerHalfOpen lets a few probe calls through to see whether the
+	// endpoint recovered.
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerPolicy configures the circuit breakers of a client, one per endpoint
+// or, with PerMethod, one per endpoint and method.
+//
+// A closed breaker opens when ConsecutiveFailures calls fail in a row, or
+// when at least MinRequests calls were made within Window and ErrorRate of
+// them failed. After OpenDuration it lets HalfOpenRequests probes through and
+// closes once they all succeed; any failing probe opens it again.
+type BreakerPolicy struct {
+	// Window is the sliding window the error rate is computed over, 10s when 0.
+	Window time.Duration
+	// MinRequests keeps a handful of calls from opening the breaker, 20 when 0.
+	MinRequests int
+	// ErrorRate is the failing fraction that opens the breaker, 0.5 when 0.
+	ErrorRate float64
+	// ConsecutiveFailures opens the breaker regardless of the rate, 0 disables it.
+	ConsecutiveFailures int
+	// OpenDuration is how long the breaker fails calls fast, 5s when 0.
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of probes, 1 when 0.
+	HalfOpenRequests int
+	// FailureCodes are the codes counted as failures besides transport
+	// errors, by default Unavailable, Internal and DeadlineExceeded. Errors
+	// of the application, e.g. InvalidArgument, never count.
+	FailureCodes []status.Code
+	// PerMethod tracks every "Service.Method" of an endpoint separately, so a
+	// broken method doesn't cut off the healthy ones.
+	PerMethod bool
+	// OnStateChange, when set, is called on every transition, e.g. to alert.
+	// name is the endpoint URL, followed by the method with PerMethod.
+	OnStateChange func(name string, from, to BreakerState)
+}
+
+var defaultFailureCodes = []status.Code{status.Unavailable, status.Internal, status.DeadlineExceeded}
+
+// windowBuckets is the resolution of the sliding window.
+const windowBuckets = 10
+
+func (policy *BreakerPolicy) window() time.Duration {
+	if policy.Window > 0 {
+		return policy.Window
+	}
+	return 10 * time.Second
+}
+
+func (policy *BreakerPolicy) minRequests() int {
+	if policy.MinRequests > 0 {
+		return policy.MinRequests
+	}
+	return 20
+}
+
+func (policy *BreakerPolicy) errorRate() float64 {
+	if policy.ErrorRate > 0 {
+		return policy.ErrorRate
+	}
+	return 0.5
+}
+
+func (policy *BreakerPolicy) openDuration() time.Duration {
+	if policy.OpenDuration > 0 {
+		return policy.OpenDuration
+	}
+	return 5 * time.Second
+}
+
+func (policy *BreakerPolicy) halfOpenRequests() int {
+	if policy.HalfOpenRequests > 0 {
+		return policy.HalfOpenRequests
+	}
+	return 1
+}
+
+// outcome is what a call tells the breaker about its endpoint.
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeAbandoned is a call cancelled by the caller, or a hedge copy
+	// that lost, which says nothing about the endpoint.
+	outcomeAbandoned
+)
+
+// outcome tells how err counts for the breaker. An endpoint that lets the
+// deadline pass has failed, whatever the codes.
+func (policy *BreakerPolicy) outcome(ctx context.Context, err error) outcome {
+	switch ctx.Err() {
+	case context.Canceled:
+		return outcomeAbandoned
+	case context.DeadlineExceeded:
+		return outcomeFailure
+	}
+	if err == nil {
+		return outcomeSuccess
+	}
+	var statusErr *status.Error
+	if !errors.As(err, &statusErr) {
+		return outcomeFailure
+	}
+	codes := policy.FailureCodes
+	if codes == nil {
+		codes = defaultFailureCodes
+	}
+	for _, code := range codes {
+		if statusErr.Code == code {
+			return outcomeFailure
+		}
+	}
+	return outcomeSuccess
+}
+
+type bucket struct {
+	start               time.Time
+	successes, failures int
+}
+
+type circuitBreaker struct {
+	name   string
+	policy *BreakerPolicy
+
+	mu          sync.Mutex
+	state       BreakerState
+	generation  uint64 // bumped on every transition to drop stale outcomes
+	buckets     [windowBuckets]bucket
+	consecutive int
+	openUntil   time.Time
+	probes      int // half-open probes let through
+	probesOK    int
+}
+
+type transition struct {
+	from, to BreakerState
+}
+
+// currentState moves an open breaker to half-open once its time is up.
+// Callers hold mu.
+func (b *circuitBreaker) currentState(now time.Time, transitions *[]transition) BreakerState {
+	if b.state == BreakerOpen && !now.Before(b.openUntil) {
+		b.setState(BreakerHalfOpen, now, transitions)
+	}
+	return b.state
+}
+
+func (b *circuitBreaker) setState(state BreakerState, now time.Time, transitions *[]transition) {
+	*transitions = append(*transitions, transition{b.state, state})
+	b.state = state
+	b.generation++
+	b.consecutive, b.probes, b.probesOK = 0, 0, 0
+	b.buckets = [windowBuckets]bucket{}
+	if state == BreakerOpen {
+		b.openUntil = now.Add(b.policy.openDuration())
+	}
+}
+
+func (b *circuitBreaker) notify(transitions []transition) {
+	if b.policy.OnStateChange == nil {
+		return
+	}
+	for _, t := range transitions {
+		b.policy.OnStateChange(b.name, t.from, t.to)
+	}
+}
+
+// ready reports whether a call could be let through now, without claiming
+// a half-open probe.
+func (b *circuitBreaker) ready() bool {
+	var transitions []transition
+	b.mu.Lock()
+	state := b.currentState(time.Now(), &transitions)
+	ready := state == BreakerClosed || (state == BreakerHalfOpen && b.probes < b.policy.halfOpenRequests())
+	b.mu.Unlock()
+	b.notify(transitions)
+	return ready
+}
+
+// allow lets a call through, returning the generation its outcome belongs
+// to, or fails it fast with Unavailable.
+func (b *circuitBreaker) allow() (uint64, error) {
+	var transitions []transition
+	b.mu.Lock()
+	state := b.currentState(time.Now(), &transitions)
+	allowed := state == BreakerClosed
+	if state == BreakerHalfOpen && b.probes < b.policy.halfOpenRequests() {
+		b.probes++
+		allowed = true
+	}
+	generation := b.generation
+	b.mu.Unlock()
+	b.notify(transitions)
+	if !allowed {
+		return 0, status.Errorf(status.Unavailable, "rpc client: circuit breaker for %s is %s", b.name, state)
+	}
+	return generation, nil
+}
+
+// record counts the outcome of a call let through by allow. An abandoned
+// half-open probe frees its slot for another one.
+func (b *circuitBreaker) record(generation uint64, result outcome) {
+	var transitions []transition
+	now := time.Now()
+	b.mu.Lock()
+	if generation == b.generation {
+		switch {
+		case result == outcomeAbandoned:
+			if b.state == BreakerHalfOpen {
+				b.probes--
+			}
+		case b.state == BreakerClosed:
+			b.recordClosed(now, result == outcomeFailure, &transitions)
+		case b.state == BreakerHalfOpen:
+			if result == outcomeFailure {
+				b.setState(BreakerOpen, now, &transitions)
+			} else if b.probesOK++; b.probesOK >= b.policy.halfOpenRequests() {
+				b.setState(BreakerClosed, now, &transitions)
+			}
+		}
+	}
+	b.mu.Unlock()
+	b.notify(transitions)
+}
+
+func (b *circuitBreaker) recordClosed(now time.Time, failed bool, transitions *[]transition) {
+	width := b.policy.window() / windowBuckets
+	current := &b.buckets[now.UnixNano()/int64(width)%windowBuckets]
+	if start := now.Truncate(width); !current.start.Equal(start) {
+		*current = bucket{start: start}
+	}
+	if !failed {
+		current.successes++
+		b.consecutive = 0
+		return
+	}
+	current.failures++
+	b.consecutive++
+	if b.policy.ConsecutiveFailures > 0 && b.consecutive >= b.policy.ConsecutiveFailures {
+		b.setState(BreakerOpen, now, transitions)
+		return
+	}
+	var total, failures int
+	for _, bk := range b.buckets {
+		if now.Sub(bk.start) < b.policy.window() {
+			total += bk.successes + bk.failures
+			failures += bk.failures
+		}
+	}
+	if total >= b.policy.minRequests() && float64(failures) >= b.policy.errorRate()*float64(total) {
+		b.setState(BreakerOpen, now, transitions)
+	}
+}
+
+// breakers holds the circuit breakers of a client, created on first use.
+type breakers struct {
+	policy *BreakerPolicy
+	mu     sync.Mutex
+	m      map[string]*circuitBreaker
+}
+
+func (bs *breakers) get(url, serviceMethod string) *circuitBreaker {
+	name := url
+	if bs.policy.PerMethod {
+		name += " " + serviceMethod
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.m == nil {
+		bs.m = make(map[string]*circuitBreaker)
+	}
+	b, ok := bs.m[name]
+	if !ok {
+		b = &circuitBreaker{name: name, policy: bs.policy}
+		bs.m[name] = b
+	}
+	return b
+}
+
+// BreakerState returns the state of the breaker guarding calls of
+// serviceMethod to the endpoint at url; BreakerClosed without a breaker.
+func (client *Client) BreakerState(url, serviceMethod string) BreakerState {
+	if client.breakers == nil {
+		return BreakerClosed
+	}
+	b := client.breakers.get(url, serviceMethod)
+	var transitions []transition
+	b.mu.Lock()
+	state := b.currentState(time.Now(), &transitions)
+	b.mu.Unlock()
+	b.notify(transitions)
+	return state
+}
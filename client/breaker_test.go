@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rpcsimple/status"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyServer fails the calls for which fail returns a code other than OK.
+func newFlakyServer(t *testing.T, fail func(r *http.Request) status.Code) (*httptest.Server, *int32) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if code := fail(r); code != status.OK {
+			w.WriteHeader(code.HTTPStatus())
+			w.Write([]byte(`{"error":{"code":"` + string(code) + `","message":"boom"}}`))
+			return
+		}
+		w.Write([]byte(`{"result":1}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &hits
+}
+
+func TestBreaker_OpensAndRecovers(t *testing.T) {
+	var down int32 = 1
+	ts, hits := newFlakyServer(t, func(r *http.Request) status.Code {
+		if atomic.LoadInt32(&down) == 1 {
+			return status.Unavailable
+		}
+		return status.OK
+	})
+	var mu sync.Mutex
+	var changes []string
+	client := NewClient(ts.URL, WithCircuitBreaker(&BreakerPolicy{
+		ConsecutiveFailures: 3,
+		OpenDuration:        50 * time.Millisecond,
+		OnStateChange: func(name string, from, to BreakerState) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	}))
+
+	for i := 0; i < 3; i++ {
+		_assert(client.Call("Math.Add", nil, nil) != nil, "call %d should fail", i)
+	}
+	_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerOpen, "breaker should be open")
+	err := client.Call("Math.Add", nil, nil)
+	_assert(status.CodeOf(err) == status.Unavailable, "expect fail fast with Unavailable, but got %v", err)
+	_assert(atomic.LoadInt32(hits) == 3, "open breaker let a call through")
+
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	_assert(client.Call("Math.Add", nil, nil) == nil, "probe should succeed")
+	_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerClosed, "breaker should close after the probe")
+	mu.Lock()
+	defer mu.Unlock()
+	_assert(len(changes) == 3 && changes[0] == "closed->open" && changes[1] == "open->half-open" && changes[2] == "half-open->closed",
+		"wrong transitions %v", changes)
+}
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	var n int32
+	ts, _ := newFlakyServer(t, func(r *http.Request) status.Code {
+		if atomic.AddInt32(&n, 1)%2 == 0 {
+			return status.Internal
+		}
+		return status.OK
+	})
+	client := NewClient(ts.URL, WithCircuitBreaker(&BreakerPolicy{MinRequests: 10, ErrorRate: 0.5}))
+	for i := 0; i < 9; i++ {
+		client.Call("Math.Add", nil, nil)
+		_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerClosed, "opened before MinRequests after %d calls", i+1)
+	}
+	client.Call("Math.Add", nil, nil)
+	_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerOpen, "half the calls failed, breaker should be open")
+}
+
+func TestBreaker_PerMethod(t *testing.T) {
+	ts, _ := newFlakyServer(t, func(r *http.Request) status.Code {
+		var body RequestBody
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body.ServiceMethod {
+		case "Math.Div":
+			return status.Unavailable
+		case "Math.Sqrt":
+			return status.InvalidArgument
+		}
+		return status.OK
+	})
+	client := NewClient(ts.URL, WithCircuitBreaker(&BreakerPolicy{ConsecutiveFailures: 2, PerMethod: true}))
+	for _, method := range []string{"Math.Div", "Math.Div", "Math.Sqrt", "Math.Sqrt", "Math.Sqrt"} {
+		_assert(client.Call(method, nil, nil) != nil, "%s should fail", method)
+	}
+	_assert(client.BreakerState(ts.URL, "Math.Div") == BreakerOpen, "Math.Div breaker should be open")
+	_assert(client.BreakerState(ts.URL, "Math.Sqrt") == BreakerClosed, "application errors shouldn't open the breaker")
+	_assert(client.Call("Math.Add", nil, nil) == nil, "Math.Add should be unaffected")
+}
+
+func TestBreaker_AbandonedProbe(t *testing.T) {
+	var down, slow int32 = 1, 0
+	release := make(chan struct{})
+	ts, _ := newFlakyServer(t, func(r *http.Request) status.Code {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-release
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return status.Unavailable
+		}
+		return status.OK
+	})
+	defer close(release)
+	client := NewClient(ts.URL, WithCircuitBreaker(&BreakerPolicy{ConsecutiveFailures: 1, OpenDuration: 20 * time.Millisecond}))
+	_assert(client.Call("Math.Add", nil, nil) != nil, "call should fail")
+	_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerOpen, "breaker should be open")
+
+	atomic.StoreInt32(&down, 0)
+	atomic.StoreInt32(&slow, 1)
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := client.CallContext(ctx, "Math.Add", nil, nil)
+	_assert(err != nil, "probe should be cancelled")
+	_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerHalfOpen, "cancelled probe should leave the breaker half-open, got %s",
+		client.BreakerState(ts.URL, "Math.Add"))
+
+	atomic.StoreInt32(&slow, 0)
+	_assert(client.Call("Math.Add", nil, nil) == nil, "the freed probe slot should let another probe through")
+	_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerClosed, "breaker should close after the probe")
+}
+
+func TestBreaker_TimedOutProbe(t *testing.T) {
+	var down, slow int32 = 1, 0
+	release := make(chan struct{})
+	ts, _ := newFlakyServer(t, func(r *http.Request) status.Code {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-release
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return status.Unavailable
+		}
+		return status.OK
+	})
+	defer close(release)
+	client := NewClient(ts.URL, WithCircuitBreaker(&BreakerPolicy{ConsecutiveFailures: 1, OpenDuration: 20 * time.Millisecond}))
+	_assert(client.Call("Math.Add", nil, nil) != nil, "call should fail")
+
+	atomic.StoreInt32(&down, 0)
+	atomic.StoreInt32(&slow, 1)
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_assert(client.CallContext(ctx, "Math.Add", nil, nil) != nil, "probe should time out")
+	_assert(client.BreakerState(ts.URL, "Math.Add") == BreakerOpen, "timed out probe should re-open the breaker, got %s",
+		client.BreakerState(ts.URL, "Math.Add"))
+}
@@ -2,40 +2,83 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"log/slog"
 	"net/http"
+	"reflect"
+	"rpcsimple/codec"
+	"rpcsimple/status"
+	"rpcsimple/trace"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type Request struct {
-	Seq          uint64
-	requestBody  RequestBody
-	responseBody ResponseBody
-	Error        error
-	Done         chan *Request
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{} // pointer the result is decoded into, may be nil
+	Seq           uint64
+	Attempts      int // how many times the request was sent, retries included
+	Error         error
+	Done          chan *Request
+
+	requestBody RequestBody
+	reply       interface{} // what attempts decode into, see newReply
+	cancel      context.CancelFunc
+	span        *trace.Span
+	start       time.Time
+	peer        string       // the endpoint of the last attempt
+	tried       *endpointSet // endpoints other hedged copies went to
+	statusCode  int
+	reqSize     int
+	respSize    int
 }
 
 func (request *Request) done() {
-	request.Done <- request
+	request.cancel()
+	select {
+	case request.Done <- request:
+	default:
+		// the caller chose a Done channel without room, drop the notification
+		// rather than block the client, as net/rpc does
+	}
+}
+
+func (request *Request) setMetadata(key, value string) {
+	if request.requestBody.Metadata == nil {
+		request.requestBody.Metadata = make(map[string]string)
+	}
+	request.requestBody.Metadata[key] = value
 }
 
 type RequestBody struct {
-	ConnectTimeout int                    `json:"ConnectTimeout"`
-	HandleTimeout  int                    `json:"HandleTimeout"`
-	ServiceMethod  string                 `json:"ServiceMethod"`
-	Args           map[string]interface{} `json:"Args"`
+	ServiceMethod string            `json:"ServiceMethod"`
+	Seq           uint64            `json:"Seq"`
+	Metadata      map[string]string `json:"Metadata,omitempty"`
+	Args          interface{}       `json:"Args"`
 }
 
 type ResponseBody struct {
-	Result interface{} `json:"result"`
+	Result json.RawMessage `json:"result"`
 }
 
 type Client struct {
 	httpClient *http.Client
-	url        string
-	sending    sync.Mutex
+	endpoints  []*Endpoint
+	discovery  Discovery // when set, endpoints are looked up per service
+	resolved   map[string]*resolvedService
+	watchCtx   context.Context // stops the discovery watches on Close
+	stopWatch  context.CancelFunc
+	breakers   *breakers // nil without WithCircuitBreaker
+	hedger     *hedger   // nil without WithHedging
+	safe       sync.Map  // of the "Service.Method"s the server says are safe to repeat
+	options    options
 	lock       sync.Mutex
 	seq        uint64
 	pending    map[uint64]*Request
@@ -47,13 +90,21 @@ var _ io.Closer = (*Client)(nil)
 
 var ErrShutdown = errors.New("connection is shut down")
 
+// Close fails every pending call with ErrShutdown and rejects new ones.
 func (client *Client) Close() error {
 	client.lock.Lock()
-	defer client.lock.Unlock()
 	if client.closing {
+		client.lock.Unlock()
 		return ErrShutdown
 	}
 	client.closing = true
+	stopWatch := client.stopWatch
+	client.stopWatch = nil
+	client.lock.Unlock()
+	if stopWatch != nil {
+		stopWatch()
+	}
+	client.terminateRequests(ErrShutdown)
 	return nil
 }
 
@@ -70,6 +121,7 @@ func (client *Client) registerRequest(request *Request) (uint64, error) {
 		return 0, ErrShutdown
 	}
 	request.Seq = client.seq
+	request.requestBody.Seq = request.Seq
 	client.pending[request.Seq] = request
 	client.seq++
 	return request.Seq, nil
@@ -83,95 +135,505 @@ func (client *Client) removeRequest(seq uint64) *Request {
 	return call
 }
 
+// terminateRequests completes every pending request with err and cancels the
+// HTTP exchanges still running for them.
 func (client *Client) terminateRequests(err error) {
-	client.sending.Lock()
-	defer client.sending.Unlock()
 	client.lock.Lock()
 	defer client.lock.Unlock()
 	client.shutdown = true
-	for _, request := range client.pending {
+	for seq, request := range client.pending {
+		delete(client.pending, seq)
 		request.Error = err
+		// send may still be running the request, so only what it no
+		// longer changes is read
+		client.logCall(context.Background(), request, false)
+		if request.span != nil {
+			request.span.SetError(err)
+			request.span.End()
+		}
 		request.done()
 	}
 }
 
-func (client *Client) send(request *Request) {
-	client.sending.Lock()
-	defer client.sending.Unlock()
-	seq, err := client.registerRequest(request)
-	if err != nil {
-		request.Error = err
-		request.done()
+// send runs in its own goroutine for every request. Whoever removes the
+// request from pending, send or terminateRequests, completes it. Attempts
+// decode into a copy of the reply, so one still running after Close can't
+// write to a reply the caller already got back.
+func (client *Client) send(ctx context.Context, request *Request, opts *CallOptions) {
+	result := newReply(request.Reply)
+	request.reply = result
+	err := client.intercept(ctx, request, opts)
+	if client.removeRequest(request.Seq) == nil {
 		return
 	}
-	jsonData, err := json.Marshal(request.requestBody)
+	if err == nil {
+		setReply(request.Reply, receivedReply(request, result))
+	}
+	request.Error = err
+	client.logCall(ctx, request, true)
+	if request.span != nil {
+		request.span.SetAttribute("net.peer", request.peer)
+		request.span.SetError(err)
+		request.span.End()
+	}
+	request.done()
+}
+
+// receivedReply is the reply the call was decoded into: the one the interceptors
+// passed to the invoker when it has the caller's type, the one they got
+// otherwise, as they filled it in themselves.
+func receivedReply(request *Request, result interface{}) interface{} {
+	if reflect.TypeOf(request.reply) == reflect.TypeOf(result) {
+		return request.reply
+	}
+	return result
+}
+
+// invoke makes the attempts the retry policy allows.
+func (client *Client) invoke(ctx context.Context, request *Request) error {
+	policy := client.options.retry
+	for {
+		var err error
+		if client.hedger != nil && client.hedger.policy.hedged(request.ServiceMethod) {
+			err = client.hedge(ctx, request)
+		} else {
+			request.Attempts++
+			err = client.attempt(ctx, request)
+		}
+		if policy == nil {
+			return err
+		}
+		if policy.Budget != nil {
+			if err == nil {
+				policy.Budget.onSuccess()
+			} else {
+				policy.Budget.onFailure()
+			}
+		}
+		if err == nil || request.Attempts >= policy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		_, keyed := ctx.Value(idempotencyKey{}).(string)
+		_, safe := client.safe.Load(request.ServiceMethod)
+		if !policy.retryable(request.ServiceMethod, keyed || safe, err) {
+			return err
+		}
+		if policy.Budget != nil && !policy.Budget.allow() {
+			client.getLogger().Warn("rpc client: retry budget exhausted", "method", request.ServiceMethod, "seq", request.Seq, "error", err)
+			return err
+		}
+		backoff := policy.backoff(request.Attempts)
+		client.getLogger().Info("rpc client: retrying", "method", request.ServiceMethod, "seq", request.Seq,
+			"attempt", request.Attempts+1, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err())
+		}
+	}
+}
+
+// attempt sends the request once, to the endpoint the balancer picks.
+func (client *Client) attempt(ctx context.Context, request *Request) error {
+	request.setMetadata(codec.MetadataAttempt, strconv.Itoa(request.Attempts))
+	if client.options.retry != nil && client.options.retry.PerAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.options.retry.PerAttemptTimeout)
+		defer cancel()
+	}
+	endpoint, err := client.pick(ctx, request)
 	if err != nil {
-		request.Error = err
-		request.done()
-		return
+		return err
+	}
+	request.peer = endpoint.url
+	var breaker *circuitBreaker
+	var generation uint64
+	if client.breakers != nil {
+		breaker = client.breakers.get(endpoint.url, request.ServiceMethod)
+		if generation, err = breaker.allow(); err != nil {
+			return err
+		}
 	}
-	resp, err := client.httpClient.Post(client.url, "application/json", bytes.NewBuffer(jsonData))
+	endpoint.begin()
+	err = client.roundTrip(ctx, request, endpoint.url)
+	endpoint.end(endpointFailed(ctx, err), client.options.ejectAfter, client.options.ejection)
+	if breaker != nil {
+		breaker.record(generation, client.breakers.policy.outcome(ctx, err))
+	}
+	return err
+}
+
+// pick asks the balancer for an endpoint among the healthy ones, or among all
+// of them when none is: a struggling endpoint beats failing every call.
+// Endpoints whose circuit breaker is open are never picked, and the call
+// fails fast when that leaves none.
+func (client *Client) pick(ctx context.Context, request *Request) (*Endpoint, error) {
+	endpoints, err := client.endpointsFor(ctx, request.ServiceMethod)
 	if err != nil {
-		request := client.removeRequest(seq)
-		if request != nil {
-			request.Error = err
-			request.done()
+		return nil, err
+	}
+	if client.breakers != nil {
+		closed := make([]*Endpoint, 0, len(endpoints))
+		for _, e := range endpoints {
+			if client.breakers.get(e.url, request.ServiceMethod).ready() {
+				closed = append(closed, e)
+			}
 		}
-		return
+		if len(closed) == 0 && len(endpoints) > 0 {
+			return nil, status.Errorf(status.Unavailable, "rpc client: circuit breakers of all endpoints are open for %s", request.ServiceMethod)
+		}
+		endpoints = closed
 	}
-	defer resp.Body.Close()
+	if len(endpoints) == 0 {
+		return nil, status.New(status.Unavailable, "rpc client: no endpoint available")
+	}
+	healthy := make([]*Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if e.Healthy() {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = endpoints
+	}
+	if request.tried != nil {
+		healthy = request.tried.without(healthy)
+	}
+	endpoint := client.options.balancer.Pick(healthy, PickInfo{
+		ServiceMethod: request.ServiceMethod,
+		Args:          request.Args,
+		Metadata:      request.requestBody.Metadata,
+	})
+	if endpoint == nil {
+		return nil, status.New(status.Unavailable, "rpc client: no endpoint available")
+	}
+	if request.tried != nil {
+		request.tried.add(endpoint)
+	}
+	return endpoint, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		request.Error = errors.New("Non-OK HTTP status: " + resp.Status)
-		request.done()
-		return
+// endpointFailed tells whether err says something about the endpoint's
+// health rather than about the call: it couldn't be reached, is unavailable
+// or let the deadline pass. Cancellations by the caller don't count.
+func endpointFailed(ctx context.Context, err error) bool {
+	switch {
+	case err == nil || ctx.Err() == context.Canceled:
+		return false
+	case ctx.Err() == context.DeadlineExceeded:
+		return true
 	}
+	var statusErr *status.Error
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == status.Unavailable
+	}
+	return true
+}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+// Endpoints returns the endpoints calls are balanced over, those of every
+// service looked up so far with discovery.
+func (client *Client) Endpoints() []*Endpoint {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	endpoints := append([]*Endpoint(nil), client.endpoints...)
+	for _, resolved := range client.resolved {
+		endpoints = append(endpoints, resolved.endpoints...)
+	}
+	return endpoints
+}
+
+func (client *Client) roundTrip(ctx context.Context, request *Request, url string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		// sent as late as possible so the server sees what is really left
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining <= 0 {
+			return status.FromContextError(context.DeadlineExceeded)
+		}
+		request.setMetadata(codec.MetadataTimeout, strconv.FormatInt(remaining, 10))
+	}
+	body, contentType, err := client.encodeRequest(request)
 	if err != nil {
-		request.Error = err
-		request.done()
-		return
+		return err
+	}
+	request.reqSize = len(body)
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", contentType)
+	httpRequest.Header.Set("User-Agent", client.options.userAgent)
+	// metadata travels twice: as headers for proxies, in the body for codecs
+	for key, value := range request.requestBody.Metadata {
+		httpRequest.Header.Set(key, value)
+	}
+	resp, err := client.httpClient.Do(httpRequest)
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err())
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	request.statusCode = resp.StatusCode
+	if resp.Header.Get(codec.MetadataSafeToRepeat) == "true" {
+		client.safe.Store(request.ServiceMethod, true)
+	} else if resp.StatusCode == http.StatusOK {
+		client.safe.Delete(request.ServiceMethod)
 	}
 
-	var responseBody ResponseBody
-	err = json.Unmarshal(bodyBytes, &responseBody)
+	bodyBytes, err := io.ReadAll(resp.Body)
+	request.respSize = len(bodyBytes)
 	if err != nil {
-		request.Error = err
-		request.done()
-		return
+		return err
 	}
-	request.responseBody = responseBody
-	request.done()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp, bodyBytes)
+	}
+
+	return client.decodeReply(bodyBytes, request.reply)
 }
 
-func (client *Client) Go(serviceMethod string, args interface{}) *Request {
+// encodeRequest encodes the request with the configured codec, or as the
+// JSON envelope RequestBody when there is none.
+func (client *Client) encodeRequest(request *Request) ([]byte, string, error) {
+	if client.options.codec == "" {
+		body, err := json.Marshal(request.requestBody)
+		return body, "application/json", err
+	}
+	newCodec, ok := codec.NewCodecFuncMap[client.options.codec]
+	if !ok {
+		return nil, "", fmt.Errorf("rpc client: invalid codec type %s", client.options.codec)
+	}
+	var buf bytes.Buffer
+	header := &codec.Header{
+		ServiceMethod: request.ServiceMethod,
+		Seq:           request.Seq,
+		Metadata:      request.requestBody.Metadata,
+	}
+	if err := newCodec(codec.Conn(nil, &buf)).Write(header, request.Args); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), string(client.options.codec), nil
+}
 
-	done := make(chan *Request, 1)
+func (client *Client) decodeReply(body []byte, reply interface{}) error {
+	if client.options.codec == "" {
+		var responseBody ResponseBody
+		if err := json.Unmarshal(body, &responseBody); err != nil {
+			return err
+		}
+		if reply == nil {
+			return nil
+		}
+		return decodeResult(responseBody.Result, reply)
+	}
+	cc := codec.NewCodecFuncMap[client.options.codec](codec.Conn(bytes.NewReader(body), nil))
+	var header codec.Header
+	if err := cc.ReadHeader(&header); err != nil {
+		return err
+	}
+	if header.Error != "" {
+		return status.New(status.Unknown, header.Error)
+	}
+	if reply == nil {
+		return nil
+	}
+	return cc.ReadBody(reply)
+}
+
+// decodeResult decodes numbers held in interface{} values as json.Number
+// rather than float64, so integers beyond 2^53 survive the trip.
+func decodeResult(result json.RawMessage, reply interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(result))
+	dec.UseNumber()
+	return dec.Decode(reply)
+}
+
+// Invoke calls serviceMethod with args of any JSON-encodable type and returns
+// the result decoded as Reply, e.g.
+//
+//	sum, err := client.Invoke[Args, int](ctx, c, "Math.Add", Args{A: 1, B: 2})
+func Invoke[Args, Reply any](ctx context.Context, client *Client, serviceMethod string, args Args, opts ...CallOption) (Reply, error) {
+	var reply Reply
+	err := client.CallContext(ctx, serviceMethod, args, &reply, opts...)
+	return reply, err
+}
+
+// Go invokes the method asynchronously. args may be any JSON-encodable
+// value. It returns the Request right away and signals completion on done,
+// which is allocated when nil and must be buffered otherwise. opts apply to
+// this call only, see CallOptions.
+func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Request, opts ...CallOption) *Request {
+	return client.GoContext(context.Background(), serviceMethod, args, reply, done, opts...)
+}
+
+// GoContext is Go under ctx: its deadline is sent along so the server stops
+// at the same time, its trace context is propagated and cancelling it
+// abandons the HTTP exchange.
+func (client *Client) GoContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Request, opts ...CallOption) *Request {
+	if done == nil {
+		done = make(chan *Request, 10)
+	} else if cap(done) == 0 {
+		log.Panic("rpc client: done channel is unbuffered")
+	}
 
 	requestBody := RequestBody{
-		ConnectTimeout: 10,
-		HandleTimeout:  10,
-		ServiceMethod:  serviceMethod,
-		Args:           args.(map[string]interface{}),
+		ServiceMethod: serviceMethod,
+		Args:          args,
 	}
 	request := &Request{
-		requestBody: requestBody,
-		Done:        done,
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+		requestBody:   requestBody,
+		start:         time.Now(),
+	}
+	callOptions := &CallOptions{Metadata: make(map[string]string)}
+	for key, value := range client.options.metadata {
+		callOptions.Metadata[key] = value
+	}
+	for _, opt := range opts {
+		opt(callOptions)
 	}
-	client.send(request)
+	timeout := client.options.timeout
+	if callOptions.Timeout > 0 {
+		timeout = callOptions.Timeout
+	}
+	if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+		ctx, request.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, request.cancel = context.WithCancel(ctx)
+	}
+	if _, err := client.registerRequest(request); err != nil {
+		request.Error = err
+		request.done()
+		return request
+	}
+	ctx, request.span = client.startSpan(ctx, serviceMethod)
+	trace.Inject(trace.SpanContextFromContext(ctx), func(key, value string) {
+		callOptions.Metadata[key] = value
+	})
+	if key, ok := ctx.Value(idempotencyKey{}).(string); ok {
+		callOptions.Metadata[codec.MetadataIdempotencyKey] = key
+	}
+	go client.send(ctx, request, callOptions)
 	return request
 }
 
-func (client *Client) Call(serviceMethod string, args interface{}) *ResponseBody {
-	request := client.Go(serviceMethod, args)
-	return &request.responseBody
+// Call invokes the method, waits for it to complete and decodes the result
+// into reply.
+func (client *Client) Call(serviceMethod string, args, reply interface{}, opts ...CallOption) error {
+	return client.CallContext(context.Background(), serviceMethod, args, reply, opts...)
+}
+
+// CallContext is Call under ctx, see GoContext. Handlers that take a context
+// pass it here so their calls stay in the trace and within the caller's deadline.
+func (client *Client) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...CallOption) error {
+	request := <-client.GoContext(ctx, serviceMethod, args, reply, make(chan *Request, 1), opts...).Done
+	return request.Error
 }
 
-func NewClient(url string) *Client {
-	return &Client{
-		httpClient: &http.Client{},
-		url:        url,
+// NewClient returns a client calling the server whose call endpoint is
+// target, e.g. "http://127.0.0.1:9999/call".
+func NewClient(target string, opts ...Option) *Client {
+	return NewBalancedClient([]Target{{URL: target}}, opts...)
+}
+
+// NewDiscoveryClient returns a client finding the endpoints of each service
+// it calls with d, and following their changes. The balancer, the health
+// checks and the circuit breakers apply to them as with NewBalancedClient.
+func NewDiscoveryClient(d Discovery, opts ...Option) *Client {
+	client := NewBalancedClient(nil, opts...)
+	client.discovery = d
+	client.resolved = make(map[string]*resolvedService)
+	return client
+}
+
+// NewBalancedClient returns a client spreading calls over replicas of a
+// server with the balancer given by WithBalancer. Endpoints failing in a row
+// are ejected for a while, see WithEjection.
+func NewBalancedClient(targets []Target, opts ...Option) *Client {
+	o := newOptions(opts)
+	endpoints := make([]*Endpoint, len(targets))
+	for i, target := range targets {
+		endpoints[i] = newEndpoint(target)
+	}
+	client := &Client{
+		httpClient: &http.Client{Transport: o.transport},
+		endpoints:  endpoints,
+		options:    o,
 		pending:    make(map[uint64]*Request),
 	}
+	if o.breaker != nil {
+		client.breakers = &breakers{policy: o.breaker}
+	}
+	if o.hedging != nil {
+		client.hedger = newHedger(o.hedging)
+	}
+	return client
+}
+
+func (client *Client) getLogger() *slog.Logger {
+	if client.options.logger == nil {
+		return slog.Default()
+	}
+	return client.options.logger
+}
+
+// logCall writes one debug line per call, the client side of the server's
+// access log. The attempts of requests not complete are left out.
+func (client *Client) logCall(ctx context.Context, request *Request, complete bool) {
+	attrs := []slog.Attr{
+		slog.String("method", request.ServiceMethod),
+		slog.Uint64("seq", request.Seq),
+		slog.Duration("latency", time.Since(request.start)),
+	}
+	if complete {
+		attrs = append(attrs,
+			slog.Int("attempts", request.Attempts),
+			slog.String("peer", request.peer),
+			slog.Int("status", request.statusCode),
+			slog.Int("req_bytes", request.reqSize),
+			slog.Int("resp_bytes", request.respSize),
+		)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID.String()))
+	}
+	if request.Error != nil {
+		attrs = append(attrs, slog.String("error", request.Error.Error()))
+	}
+	client.getLogger().LogAttrs(ctx, slog.LevelDebug, "rpc client: call", attrs...)
+}
+
+func (client *Client) startSpan(ctx context.Context, serviceMethod string) (context.Context, *trace.Span) {
+	if client.options.tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := client.options.tracer.Start(ctx, serviceMethod, trace.KindClient)
+	span.SetAttribute("rpc.method", serviceMethod)
+	return ctx, span
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey marks calls made with the returned context as retries of
+// one logical call: the server runs the method once per key and replays the
+// stored outcome for every duplicate.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// decodeError turns a non-OK response into a *status.Error, guessing the code
+// from the HTTP status when the body isn't one of ours.
+func decodeError(resp *http.Response, body []byte) *status.Error {
+	var errorBody struct {
+		Error *status.Error `json:"error"`
+	}
+	if json.Unmarshal(body, &errorBody) == nil && errorBody.Error != nil && errorBody.Error.Code != "" {
+		return errorBody.Error
+	}
+	return status.New(status.FromHTTPStatus(resp.StatusCode), "non-OK HTTP status: "+resp.Status)
 }
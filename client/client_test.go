@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"rpcsimple/status"
+	"rpcsimple/trace"
 	"testing"
 )
 
@@ -28,3 +31,58 @@ func TestClient_dialTimeout(t *testing.T) {
 	// response := client.Call("Math.Add", args)
 	log.Printf("Response: %v", resp)
 }
+
+func TestClient_GoIsAsynchronous(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"result":3}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(ts.URL)
+	var reply int
+	request := client.Go("Math.Add", map[string]interface{}{"A": 1, "B": 2}, &reply, nil)
+	select {
+	case <-request.Done:
+		t.Fatal("Go should return before the call completes")
+	default:
+	}
+	close(release)
+	request = <-request.Done
+	_assert(request.Error == nil && reply == 3, "wrong reply %d: %v", reply, request.Error)
+}
+
+func TestClient_CloseFailsPending(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	exporter := trace.NewInMemoryExporter()
+	client := NewClient(ts.URL, WithTracer(trace.NewTracer(exporter)))
+	done := make(chan *Request, 2)
+	client.Go("Math.Add", map[string]interface{}{}, nil, done)
+	client.Go("Math.Add", map[string]interface{}{}, nil, done)
+	_assert(client.Close() == nil, "first Close should succeed")
+	for i := 0; i < 2; i++ {
+		request := <-done
+		_assert(request.Error == ErrShutdown, "pending call should fail with ErrShutdown, got %v", request.Error)
+	}
+	_assert(len(exporter.Spans()) == 2, "spans of failed calls should end, got %d", len(exporter.Spans()))
+	_assert(client.Call("Math.Add", map[string]interface{}{}, nil) == ErrShutdown, "closed client should reject calls")
+	_assert(client.Close() == ErrShutdown, "second Close should fail")
+}
+
+func TestClient_CallReturnsStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":"NotFound","message":"no Math.Sub"}}`))
+	}))
+	defer ts.Close()
+
+	err := NewClient(ts.URL).Call("Math.Sub", map[string]interface{}{}, nil)
+	_assert(status.CodeOf(err) == status.NotFound, "expect NotFound, but got %v", err)
+}
@@ -0,0 +1,395 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"rpcsimple/discovery"
+	"rpcsimple/status"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discovery tells a client where the servers of a service are, so replicas
+// can come and go without restarting the client.
+type Discovery interface {
+	// Get returns the endpoints of service as currently known.
+	Get(ctx context.Context, service string) ([]Target, error)
+	// Watch returns a channel receiving the endpoints of service every time
+	// they change, until ctx is done and it is closed. A slow reader only
+	// misses intermediate lists, never the latest one.
+	Watch(ctx context.Context, service string) (<-chan []Target, error)
+	// Refresh reloads the endpoints from their source now instead of at the
+	// next poll.
+	Refresh(ctx context.Context) error
+}
+
+// watchers fans changes out to the channels returned by Watch.
+type watchers struct {
+	mu   sync.Mutex
+	subs map[string][]chan []Target
+}
+
+func (w *watchers) add(ctx context.Context, service string) <-chan []Target {
+	ch := make(chan []Target, 1)
+	w.mu.Lock()
+	if w.subs == nil {
+		w.subs = make(map[string][]chan []Target)
+	}
+	w.subs[service] = append(w.subs[service], ch)
+	w.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		subs := w.subs[service]
+		for i, sub := range subs {
+			if sub == ch {
+				w.subs[service] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (w *watchers) services() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	services := make([]string, 0, len(w.subs))
+	for service, subs := range w.subs {
+		if len(subs) > 0 {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+func (w *watchers) publish(service string, targets []Target) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.subs[service] {
+		// replace a list the reader hasn't taken yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- targets
+	}
+}
+
+// StaticDiscovery serves the same fixed endpoints for every service.
+type StaticDiscovery struct {
+	targets []Target
+}
+
+func NewStaticDiscovery(targets ...Target) *StaticDiscovery {
+	return &StaticDiscovery{targets: targets}
+}
+
+func (d *StaticDiscovery) Get(ctx context.Context, service string) ([]Target, error) {
+	return d.targets, nil
+}
+
+func (d *StaticDiscovery) Watch(ctx context.Context, service string) (<-chan []Target, error) {
+	ch := make(chan []Target)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (d *StaticDiscovery) Refresh(ctx context.Context) error {
+	return nil
+}
+
+// FileDiscovery reads the endpoints from a JSON file mapping service names
+// to targets, with "*" for the services not listed:
+//
+//	{
+//		"Math": [{"url": "http://10.0.0.7:9999/call", "weight": 2}],
+//		"*":    [{"url": "http://10.0.0.8:9999/call"}]
+//	}
+//
+// The file is polled for changes, so editing it moves the traffic.
+type FileDiscovery struct {
+	path     string
+	watchers watchers
+
+	mu       sync.Mutex
+	contents []byte
+	services map[string][]Target
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFileDiscovery reads path and then checks it for changes every interval
+// until Close.
+func NewFileDiscovery(path string, interval time.Duration) (*FileDiscovery, error) {
+	d := &FileDiscovery{path: path, stop: make(chan struct{})}
+	if err := d.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	go d.poll(interval)
+	return d, nil
+}
+
+func (d *FileDiscovery) Get(ctx context.Context, service string) ([]Target, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.targetsLocked(service), nil
+}
+
+func (d *FileDiscovery) targetsLocked(service string) []Target {
+	if targets, ok := d.services[service]; ok {
+		return targets
+	}
+	return d.services["*"]
+}
+
+func (d *FileDiscovery) Watch(ctx context.Context, service string) (<-chan []Target, error) {
+	return d.watchers.add(ctx, service), nil
+}
+
+// Refresh reads the file, notifying the watchers of the services whose
+// endpoints changed. A file that can't be parsed leaves the endpoints as
+// they were.
+func (d *FileDiscovery) Refresh(ctx context.Context) error {
+	contents, err := os.ReadFile(d.path)
+	if err != nil {
+		return fmt.Errorf("rpc client: discovery file: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.services != nil && bytes.Equal(contents, d.contents) {
+		return nil
+	}
+	var services map[string][]Target
+	if err := json.Unmarshal(contents, &services); err != nil {
+		return fmt.Errorf("rpc client: discovery file %s: %w", d.path, err)
+	}
+	old := d.services
+	d.contents, d.services = contents, services
+	for _, service := range d.watchers.services() {
+		targets := d.targetsLocked(service)
+		if old == nil || !reflect.DeepEqual(old[service], services[service]) || !reflect.DeepEqual(old["*"], services["*"]) {
+			d.watchers.publish(service, targets)
+		}
+	}
+	return nil
+}
+
+func (d *FileDiscovery) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a half-written file is picked up at the next tick
+			d.Refresh(context.Background())
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Close stops polling the file.
+func (d *FileDiscovery) Close() error {
+	d.stopOnce.Do(func() { close(d.stop) })
+	return nil
+}
+
+// RegistryDiscovery asks a discovery server, see package discovery, and
+// long-polls it for changes.
+type RegistryDiscovery struct {
+	client   *discovery.Client
+	watchers watchers
+}
+
+// NewRegistryDiscovery uses the discovery server at baseURL, e.g.
+// "http://127.0.0.1:7946".
+func NewRegistryDiscovery(baseURL string) *RegistryDiscovery {
+	return &RegistryDiscovery{client: discovery.NewClient(baseURL)}
+}
+
+func (d *RegistryDiscovery) Get(ctx context.Context, service string) ([]Target, error) {
+	instances, err := d.client.Instances(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	return instanceTargets(instances), nil
+}
+
+// watchWait is how long each long-poll waits for a change.
+const watchWait = 30 * time.Second
+
+func (d *RegistryDiscovery) Watch(ctx context.Context, service string) (<-chan []Target, error) {
+	ch := d.watchers.add(ctx, service)
+	go func() {
+		var version uint64
+		for ctx.Err() == nil {
+			instances, err := d.client.Watch(ctx, service, version, watchWait)
+			if err != nil {
+				// the discovery server is down, keep the endpoints we know
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			if instances.Version != version {
+				version = instances.Version
+				d.watchers.publish(service, instanceTargets(instances))
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Refresh fetches the endpoints of every watched service.
+func (d *RegistryDiscovery) Refresh(ctx context.Context) error {
+	for _, service := range d.watchers.services() {
+		targets, err := d.Get(ctx, service)
+		if err != nil {
+			return err
+		}
+		d.watchers.publish(service, targets)
+	}
+	return nil
+}
+
+func instanceTargets(instances discovery.Instances) []Target {
+	targets := make([]Target, len(instances.Instances))
+	for i, instance := range instances.Instances {
+		targets[i] = Target{URL: instance.Addr, Weight: instance.Weight}
+	}
+	return targets
+}
+
+// refreshInterval is how often a service without endpoints makes calls ask
+// the discovery source again, rather than wait for the watch.
+const refreshInterval = time.Second
+
+// resolvedService holds the endpoints of a service found with discovery.
+// ready is closed once the first lookup finished, err tells how.
+type resolvedService struct {
+	ready       chan struct{}
+	err         error
+	endpoints   []*Endpoint
+	lastRefresh time.Time
+}
+
+// endpointsFor returns the endpoints serviceMethod may be sent to. With
+// discovery the first call of a service looks its endpoints up and starts
+// watching them.
+func (client *Client) endpointsFor(ctx context.Context, serviceMethod string) ([]*Endpoint, error) {
+	client.lock.Lock()
+	if client.discovery == nil {
+		defer client.lock.Unlock()
+		return client.endpoints, nil
+	}
+	if client.closing || client.shutdown {
+		client.lock.Unlock()
+		return nil, ErrShutdown
+	}
+	service := serviceMethod
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		service = serviceMethod[:dot]
+	}
+	// every version of a service is announced under its name
+	service, _, _ = strings.Cut(service, "@")
+	resolved, ok := client.resolved[service]
+	if !ok {
+		resolved = &resolvedService{ready: make(chan struct{})}
+		client.resolved[service] = resolved
+		if client.stopWatch == nil {
+			client.watchCtx, client.stopWatch = context.WithCancel(context.Background())
+		}
+		go client.resolve(client.watchCtx, service, resolved)
+	}
+	client.lock.Unlock()
+
+	select {
+	case <-resolved.ready:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err())
+	}
+	if resolved.err != nil {
+		return nil, status.Errorf(status.Unavailable, "rpc client: discovery of %s failed: %v", service, resolved.err)
+	}
+	client.lock.Lock()
+	endpoints := resolved.endpoints
+	refresh := len(endpoints) == 0 && time.Since(resolved.lastRefresh) >= refreshInterval
+	if refresh {
+		resolved.lastRefresh = time.Now()
+	}
+	client.lock.Unlock()
+	if refresh {
+		// the source may know better than the last poll, asked once per
+		// interval so that a service gone doesn't flood it
+		if client.discovery.Refresh(ctx) == nil {
+			if targets, err := client.discovery.Get(ctx, service); err == nil {
+				client.lock.Lock()
+				resolved.endpoints = mergeEndpoints(resolved.endpoints, targets)
+				endpoints = resolved.endpoints
+				client.lock.Unlock()
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// resolve looks the endpoints of service up, then follows their changes
+// until the client is closed. A failed lookup is forgotten so the next call
+// tries again.
+func (client *Client) resolve(ctx context.Context, service string, resolved *resolvedService) {
+	targets, err := client.discovery.Get(ctx, service)
+	var changes <-chan []Target
+	if err == nil {
+		changes, err = client.discovery.Watch(ctx, service)
+	}
+	client.lock.Lock()
+	if err != nil {
+		delete(client.resolved, service)
+		resolved.err = err
+	} else {
+		resolved.endpoints = mergeEndpoints(nil, targets)
+	}
+	client.lock.Unlock()
+	close(resolved.ready)
+	if err != nil {
+		client.getLogger().Warn("rpc client: discovery failed", "service", service, "error", err)
+		return
+	}
+	for targets := range changes {
+		client.lock.Lock()
+		resolved.endpoints = mergeEndpoints(resolved.endpoints, targets)
+		client.lock.Unlock()
+		client.getLogger().Info("rpc client: endpoints changed", "service", service, "endpoints", len(targets))
+	}
+}
+
+// mergeEndpoints returns endpoints for targets, keeping the state of those
+// already known.
+func mergeEndpoints(known []*Endpoint, targets []Target) []*Endpoint {
+	byURL := make(map[string]*Endpoint, len(known))
+	for _, e := range known {
+		byURL[e.url] = e
+	}
+	endpoints := make([]*Endpoint, 0, len(targets))
+	for _, target := range targets {
+		e, ok := byURL[target.URL]
+		if !ok || e.weight != newEndpoint(target).weight {
+			e = newEndpoint(target)
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rpcsimple/discovery"
+	"rpcsimple/status"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// eventually polls cond for up to a second.
+func eventually(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func replicaOf(client *Client, serviceMethod string) int {
+	replica := -1
+	if err := client.Call(serviceMethod, nil, &replica); err != nil {
+		return -1
+	}
+	return replica
+}
+
+func TestDiscovery_Static(t *testing.T) {
+	client := NewDiscoveryClient(NewStaticDiscovery(newReplicas(t, 2)...))
+	defer client.Close()
+	counts := countReplies(client, 10, nil)
+	_assert(counts[0] == 5 && counts[1] == 5, "uneven spread %v", counts)
+}
+
+func TestDiscovery_File(t *testing.T) {
+	targets := newReplicas(t, 3)
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	write := func(services map[string][]Target) {
+		contents, _ := json.Marshal(services)
+		_assert(os.WriteFile(path, contents, 0o644) == nil, "failed to write %s", path)
+	}
+	write(map[string][]Target{"Math": {targets[0]}, "*": {targets[2]}})
+	d, err := NewFileDiscovery(path, 10*time.Millisecond)
+	_assert(err == nil, "failed to read %s: %v", path, err)
+	defer d.Close()
+	client := NewDiscoveryClient(d)
+	defer client.Close()
+
+	_assert(replicaOf(client, "Math.Add") == 0, "Math should go to replica 0")
+	_assert(replicaOf(client, "Clock.Now") == 2, "other services should go to the default replica")
+	write(map[string][]Target{"Math": {targets[1]}, "*": {targets[2]}})
+	_assert(eventually(func() bool { return replicaOf(client, "Math.Add") == 1 }), "Math should move to replica 1")
+	_assert(d.Close() == nil && d.Close() == nil, "Close should be safe to call twice")
+
+	_, err = NewFileDiscovery(filepath.Join(t.TempDir(), "missing.json"), time.Second)
+	_assert(err != nil, "a missing file should be reported")
+}
+
+func TestDiscovery_Registry(t *testing.T) {
+	registry, err := discovery.NewServer(time.Minute)
+	_assert(err == nil, "failed to create discovery server: %v", err)
+	ts := httptest.NewServer(registry)
+	defer ts.Close()
+	defer registry.Close()
+	targets := newReplicas(t, 2)
+	registry.Register(discovery.Instance{Addr: targets[0].URL, Services: []string{"Math"}})
+
+	client := NewDiscoveryClient(NewRegistryDiscovery(ts.URL))
+	defer client.Close()
+	_assert(replicaOf(client, "Math.Add") == 0, "Math should go to replica 0")
+
+	// replace the replica, the client follows without a restart
+	registry.Register(discovery.Instance{Addr: targets[1].URL, Services: []string{"Math"}})
+	registry.Deregister(targets[0].URL)
+	_assert(eventually(func() bool { return replicaOf(client, "Math.Add") == 1 }), "Math should move to replica 1")
+	_assert(eventually(func() bool { return len(client.Endpoints()) == 1 }), "replica 0 should be dropped, got %d endpoints", len(client.Endpoints()))
+
+	err = client.Call("Clock.Now", nil, nil)
+	_assert(status.CodeOf(err) == status.Unavailable, "a service without instances should be Unavailable, got %v", err)
+}
+
+// countingDiscovery counts the refreshes calls ask for.
+type countingDiscovery struct {
+	*StaticDiscovery
+	refreshes int32
+}
+
+func (d *countingDiscovery) Refresh(ctx context.Context) error {
+	atomic.AddInt32(&d.refreshes, 1)
+	return d.StaticDiscovery.Refresh(ctx)
+}
+
+func TestDiscovery_RefreshLimited(t *testing.T) {
+	d := &countingDiscovery{StaticDiscovery: NewStaticDiscovery()}
+	client := NewDiscoveryClient(d)
+	for i := 0; i < 5; i++ {
+		_assert(client.Call("Math.Add", nil, nil) != nil, "call without endpoints should fail")
+	}
+	_assert(atomic.LoadInt32(&d.refreshes) == 1, "expect 1 refresh per interval, but got %d", d.refreshes)
+
+	_assert(client.Close() == nil, "Close should succeed")
+	_assert(client.Call("Clock.Now", nil, nil) == ErrShutdown, "closed client should not start watching")
+}
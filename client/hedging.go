@@ -0,0 +1,242 @@
+package client
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"rpcsimple/metrics"
+	"sync"
+	"time"
+)
+
+// HedgingPolicy makes the client send a copy of a slow call to another
+// endpoint and take whichever reply succeeds first, cancelling the others.
+// It trades extra load for a shorter tail, so only methods safe to run more
+// than once, typically read-only ones, should be hedged.
+type HedgingPolicy struct {
+	// Methods lists "Service.Method" patterns as understood by path.Match,
+	// e.g. "Catalog.Get*", of the methods to hedge.
+	Methods []string
+	// Delay is how long a call runs before the next copy is sent. With
+	// Percentile it only applies until enough latencies were observed.
+	Delay time.Duration
+	// Percentile, e.g. 0.95, waits for that percentile of the latencies
+	// observed for the method instead of a fixed Delay.
+	Percentile float64
+	// MaxAttempts caps the copies of one call, the first included, 2 when 0.
+	MaxAttempts int
+	// MaxRatio, e.g. 0.1, caps hedged copies at that fraction of the calls,
+	// allowing bursts of up to 10. 0 means no cap.
+	MaxRatio float64
+}
+
+// minLatencySamples are needed before Percentile replaces Delay.
+const minLatencySamples = 20
+
+const maxHedgeTokens = 10
+
+func (policy *HedgingPolicy) hedged(serviceMethod string) bool {
+	for _, pattern := range policy.Methods {
+		if ok, _ := path.Match(pattern, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *HedgingPolicy) maxAttempts() int {
+	if policy.MaxAttempts > 0 {
+		return policy.MaxAttempts
+	}
+	return 2
+}
+
+// hedger keeps what a client learned while hedging: the latencies of every
+// hedged method and the tokens left under MaxRatio.
+type hedger struct {
+	policy *HedgingPolicy
+
+	mu      sync.Mutex
+	latency map[string]*metrics.Histogram
+	tokens  float64
+}
+
+func newHedger(policy *HedgingPolicy) *hedger {
+	return &hedger{policy: policy, latency: make(map[string]*metrics.Histogram), tokens: maxHedgeTokens}
+}
+
+func (h *hedger) histogram(serviceMethod string) *metrics.Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.latency[serviceMethod]
+	if !ok {
+		hist = new(metrics.Histogram)
+		h.latency[serviceMethod] = hist
+	}
+	return hist
+}
+
+func (h *hedger) delay(serviceMethod string) time.Duration {
+	if h.policy.Percentile > 0 {
+		if hist := h.histogram(serviceMethod); hist.Count() >= minLatencySamples {
+			return hist.Quantile(h.policy.Percentile)
+		}
+	}
+	return h.policy.Delay
+}
+
+// onCall earns the tokens a call contributes to the MaxRatio cap.
+func (h *hedger) onCall() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens += h.policy.MaxRatio
+	if h.tokens > maxHedgeTokens {
+		h.tokens = maxHedgeTokens
+	}
+}
+
+func (h *hedger) allow() bool {
+	if h.policy.MaxRatio <= 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// endpointSet remembers the endpoints the copies of a call went to, so the
+// next copy goes elsewhere.
+type endpointSet struct {
+	mu sync.Mutex
+	m  map[*Endpoint]bool
+}
+
+func (set *endpointSet) add(e *Endpoint) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.m[e] = true
+}
+
+// without filters the endpoints in the set out of endpoints, unless that
+// would leave none.
+func (set *endpointSet) without(endpoints []*Endpoint) []*Endpoint {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	rest := make([]*Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if !set.m[e] {
+			rest = append(rest, e)
+		}
+	}
+	if len(rest) == 0 {
+		return endpoints
+	}
+	return rest
+}
+
+// hedge sends the request and, each time the delay passes without a
+// successful reply, a copy of it, until one succeeds or all have failed.
+func (client *Client) hedge(ctx context.Context, request *Request) error {
+	h := client.hedger
+	h.onCall()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // abandons the copies still running
+
+	type attemptResult struct {
+		dup *Request
+		err error
+	}
+	results := make(chan attemptResult, h.policy.maxAttempts())
+	tried := &endpointSet{m: make(map[*Endpoint]bool)}
+	send := func() {
+		request.Attempts++
+		dup := request.hedgeCopy(tried)
+		start := time.Now()
+		go func() {
+			err := client.attempt(ctx, dup)
+			if ctx.Err() == nil {
+				// failed attempts took time too, only abandoned ones are
+				// left out as they didn't get to finish
+				h.histogram(request.ServiceMethod).Observe(time.Since(start))
+			}
+			results <- attemptResult{dup, err}
+		}()
+	}
+	send()
+	sent, running := 1, 1
+	timer := time.NewTimer(h.delay(request.ServiceMethod))
+	defer timer.Stop()
+	var err error
+	for running > 0 {
+		select {
+		case result := <-results:
+			running--
+			request.adopt(result.dup, result.err == nil)
+			if result.err == nil {
+				return nil
+			}
+			err = result.err
+		case <-timer.C:
+			if sent < h.policy.maxAttempts() && h.allow() {
+				client.getLogger().Debug("rpc client: hedging", "method", request.ServiceMethod, "seq", request.Seq, "attempt", request.Attempts+1)
+				send()
+				sent++
+				running++
+				timer.Reset(h.delay(request.ServiceMethod))
+			}
+		}
+	}
+	return err
+}
+
+// hedgeCopy returns a copy of the request for one attempt, with metadata and
+// reply of its own so copies running at once don't share them.
+func (request *Request) hedgeCopy(tried *endpointSet) *Request {
+	dup := &Request{
+		ServiceMethod: request.ServiceMethod,
+		Args:          request.Args,
+		Seq:           request.Seq,
+		Attempts:      request.Attempts,
+		requestBody:   request.requestBody,
+		tried:         tried,
+	}
+	dup.requestBody.Metadata = make(map[string]string, len(request.requestBody.Metadata))
+	for key, value := range request.requestBody.Metadata {
+		dup.requestBody.Metadata[key] = value
+	}
+	dup.reply = newReply(request.reply)
+	return dup
+}
+
+// adopt takes over the outcome of a copy made by hedgeCopy, its reply too
+// when it succeeded.
+func (request *Request) adopt(dup *Request, succeeded bool) {
+	request.peer = dup.peer
+	request.statusCode = dup.statusCode
+	request.reqSize = dup.reqSize
+	request.respSize = dup.respSize
+	if succeeded {
+		setReply(request.reply, dup.reply)
+	}
+}
+
+// newReply returns a new value of the type reply points to, or reply itself
+// when it isn't a pointer to decode into.
+func newReply(reply interface{}) interface{} {
+	if v := reflect.ValueOf(reply); v.Kind() == reflect.Ptr && !v.IsNil() {
+		return reflect.New(v.Type().Elem()).Interface()
+	}
+	return reply
+}
+
+// setReply copies the value src points to into dst, both made by newReply.
+func setReply(dst, src interface{}) {
+	d, s := reflect.ValueOf(dst), reflect.ValueOf(src)
+	if d.Kind() == reflect.Ptr && !d.IsNil() && d.Pointer() != s.Pointer() {
+		d.Elem().Set(s.Elem())
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSlowReplicas starts servers replying with their index after their delay,
+// and counts the calls abandoned by the client.
+func newSlowReplicas(t *testing.T, delays ...time.Duration) ([]Target, *int32, *int32) {
+	var hits, cancelled int32
+	targets := make([]Target, len(delays))
+	for i, delay := range delays {
+		i, delay := i, delay
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			io.ReadAll(r.Body) // the server notices a cancelled call only once the body is read
+			select {
+			case <-time.After(delay):
+				fmt.Fprintf(w, `{"result":%d}`, i)
+			case <-r.Context().Done():
+				atomic.AddInt32(&cancelled, 1)
+			}
+		}))
+		t.Cleanup(ts.Close)
+		targets[i] = Target{URL: ts.URL}
+	}
+	return targets, &hits, &cancelled
+}
+
+func TestHedging_FirstReplyWins(t *testing.T) {
+	targets, _, cancelled := newSlowReplicas(t, 500*time.Millisecond, 0)
+	client := NewBalancedClient(targets, WithHedging(&HedgingPolicy{Methods: []string{"Catalog.*"}, Delay: 20 * time.Millisecond}))
+
+	var replica int
+	start := time.Now()
+	request := <-client.Go("Catalog.Get", nil, &replica, nil).Done
+	_assert(request.Error == nil, "call failed: %v", request.Error)
+	_assert(replica == 1, "expect the fast replica's reply, but got %d", replica)
+	_assert(request.Attempts == 2, "expect 2 attempts, but got %d", request.Attempts)
+	_assert(time.Since(start) < 300*time.Millisecond, "hedging didn't cut the latency: %s", time.Since(start))
+	for i := 0; atomic.LoadInt32(cancelled) == 0 && i < 100; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(atomic.LoadInt32(cancelled) == 1, "the slow copy should have been cancelled")
+
+	// methods not listed are never hedged
+	start = time.Now()
+	_assert(client.Call("Orders.Create", nil, &replica) == nil, "call failed")
+	_assert(replica == 0 && time.Since(start) >= 500*time.Millisecond, "Orders.Create shouldn't be hedged")
+}
+
+func TestHedging_MaxAttempts(t *testing.T) {
+	targets, hits, _ := newSlowReplicas(t, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	client := NewBalancedClient(targets, WithHedging(&HedgingPolicy{Methods: []string{"*"}, Delay: 10 * time.Millisecond, MaxAttempts: 2}))
+	_assert(client.Call("Catalog.Get", nil, nil) == nil, "call failed")
+	_assert(atomic.LoadInt32(hits) == 2, "expect 2 copies, but sent %d", atomic.LoadInt32(hits))
+}
+
+func TestHedging_MaxRatio(t *testing.T) {
+	h := newHedger(&HedgingPolicy{MaxRatio: 0.5})
+	hedges := 0
+	for i := 0; i < 100; i++ {
+		h.onCall()
+		if h.allow() {
+			hedges++
+		}
+	}
+	_assert(hedges == 59, "expect the 10 token burst plus one hedge every other call, but got %d", hedges)
+}
+
+func TestHedging_PercentileDelay(t *testing.T) {
+	h := newHedger(&HedgingPolicy{Delay: time.Second, Percentile: 0.9})
+	for i := 0; i < minLatencySamples-1; i++ {
+		h.histogram("Catalog.Get").Observe(5 * time.Millisecond)
+	}
+	_assert(h.delay("Catalog.Get") == time.Second, "too few samples, expect the fixed delay")
+	h.histogram("Catalog.Get").Observe(5 * time.Millisecond)
+	delay := h.delay("Catalog.Get")
+	_assert(delay > 0 && delay <= 10*time.Millisecond, "expect the observed p90, but got %s", delay)
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"rpcsimple/codec"
+	"time"
+)
+
+// CallOptions are the per-call settings an interceptor sees and may change
+// before passing the call on.
+type CallOptions struct {
+	// Metadata is sent with the call, both as HTTP headers and in the
+	// request body. It starts out holding the client's default metadata, the
+	// trace context and the idempotency key.
+	Metadata map[string]string
+	// Timeout, when positive, bounds the rest of the call.
+	Timeout time.Duration
+}
+
+// CallOption sets CallOptions for a single call.
+type CallOption func(*CallOptions)
+
+// CallMetadata adds metadata to a single call.
+func CallMetadata(key, value string) CallOption {
+	return func(o *CallOptions) { o.Metadata[key] = value }
+}
+
+// CallVersion calls the given version of the service, e.g. "v2", instead of
+// its default one.
+func CallVersion(version string) CallOption {
+	return CallMetadata(codec.MetadataVersion, version)
+}
+
+// CallTimeout bounds a single call, overriding the client's WithTimeout.
+func CallTimeout(timeout time.Duration) CallOption {
+	return func(o *CallOptions) { o.Timeout = timeout }
+}
+
+// UnaryInvoker sends a call; an interceptor calls it to pass the call on.
+type UnaryInvoker func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions) error
+
+// UnaryInterceptor wraps every call of a client. It may change the args, the
+// metadata or the timeout before calling invoker, call invoker more than once
+// to retry, or not at all to answer the call itself by filling in reply.
+// The caller gets back the reply last passed to invoker when it has the type
+// of reply; an interceptor decoding into another type fills in reply itself.
+type UnaryInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions, invoker UnaryInvoker) error
+
+// chainInterceptors returns an invoker running interceptors around invoker,
+// the first one outermost.
+func chainInterceptors(interceptors []UnaryInterceptor, invoker UnaryInvoker) UnaryInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions) error {
+			return interceptor(ctx, serviceMethod, args, reply, opts, next)
+		}
+	}
+	return invoker
+}
+
+// intercept runs the request through the client's interceptors; the last
+// one hands it to invoke.
+func (client *Client) intercept(ctx context.Context, request *Request, opts *CallOptions) error {
+	invoker := func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions) error {
+		request.Args, request.requestBody.Args, request.reply = args, args, reply
+		request.requestBody.Metadata = make(map[string]string, len(opts.Metadata))
+		for key, value := range opts.Metadata {
+			request.requestBody.Metadata[key] = value
+		}
+		if opts.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+			defer cancel()
+		}
+		return client.invoke(ctx, request)
+	}
+	return chainInterceptors(client.options.interceptors, invoker)(ctx, request.ServiceMethod, request.Args, request.reply, opts)
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rpcsimple/status"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInterceptors(t *testing.T) {
+	var hits int32
+	var header http.Header
+	var body RequestBody
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		header = r.Header
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"result":3}`))
+	}))
+	defer ts.Close()
+
+	var order []string
+	var seen CallOptions
+	trace := func(name string) UnaryInterceptor {
+		return func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions, invoker UnaryInvoker) error {
+			order = append(order, name)
+			return invoker(ctx, serviceMethod, args, reply, opts)
+		}
+	}
+	auth := func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions, invoker UnaryInvoker) error {
+		seen = *opts
+		opts.Metadata["authorization"] = "Bearer token"
+		return invoker(ctx, serviceMethod, map[string]int{"A": 1, "B": 2}, reply, opts)
+	}
+	retryOnce := func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions, invoker UnaryInvoker) error {
+		err := invoker(ctx, serviceMethod, args, reply, opts)
+		if status.CodeOf(err) == status.Unavailable {
+			err = invoker(ctx, serviceMethod, args, reply, opts)
+		}
+		return err
+	}
+	client := NewClient(ts.URL, WithInterceptors(trace("outer"), retryOnce), WithInterceptors(trace("inner"), auth))
+
+	var sum int
+	err := client.Call("Math.Add", nil, &sum, CallMetadata("x-tenant", "acme"), CallTimeout(time.Second))
+	_assert(err == nil && sum == 3, "wrong sum %d: %v", sum, err)
+	_assert(len(order) == 3 && order[0] == "outer" && order[1] == "inner" && order[2] == "inner", "wrong order %v", order)
+	_assert(seen.Metadata["x-tenant"] == "acme" && seen.Timeout == time.Second, "interceptor should see the call options %+v", seen)
+	_assert(header.Get("Authorization") == "Bearer token", "interceptor metadata should be sent")
+	args, _ := body.Args.(map[string]interface{})
+	_assert(args["A"] == 1.0 && args["B"] == 2.0, "interceptor should replace the args, but sent %v", body.Args)
+}
+
+func TestInterceptors_ShortCircuit(t *testing.T) {
+	cache := func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions, invoker UnaryInvoker) error {
+		*reply.(*int) = 42
+		return nil
+	}
+	client := NewClient("http://127.0.0.1:1/unreachable", WithInterceptors(cache))
+	answer, err := Invoke[struct{}, int](context.Background(), client, "Deep.Thought", struct{}{})
+	_assert(err == nil && answer == 42, "interceptor should answer the call, but got %d: %v", answer, err)
+}
+
+func TestInterceptors_SwapReply(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result":3}`))
+	}))
+	defer ts.Close()
+
+	swap := func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions, invoker UnaryInvoker) error {
+		return invoker(ctx, serviceMethod, args, new(int), opts)
+	}
+	var sum int
+	err := NewClient(ts.URL, WithInterceptors(swap)).Call("Math.Add", nil, &sum)
+	_assert(err == nil && sum == 3, "the reply passed to the invoker should be returned, got %d: %v", sum, err)
+
+	convert := func(ctx context.Context, serviceMethod string, args, reply interface{}, opts *CallOptions, invoker UnaryInvoker) error {
+		var raw json.Number
+		err := invoker(ctx, serviceMethod, args, &raw, opts)
+		*reply.(*string) = "sum=" + raw.String()
+		return err
+	}
+	var text string
+	err = NewClient(ts.URL, WithInterceptors(convert)).Call("Math.Add", nil, &text)
+	_assert(err == nil && text == "sum=3", "the reply filled in by the interceptor should be returned, got %q: %v", text, err)
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"rpcsimple/codec"
+	"rpcsimple/trace"
+	"time"
+)
+
+// defaultTransport is shared by every client that doesn't tune its own, so
+// concurrent calls to the same server reuse a pool of keep-alive connections
+// instead of dialing, which http.DefaultTransport's two idle connections per
+// host would force under load.
+var defaultTransport = newTransport(defaultOptions())
+
+const defaultUserAgent = "rpcsimple-client"
+
+type options struct {
+	timeout   time.Duration
+	transport http.RoundTripper
+	codec     codec.Type
+	metadata  map[string]string
+	userAgent string
+	logger    *slog.Logger
+	tracer    *trace.Tracer
+	retry     *RetryPolicy
+	balancer  Balancer
+	breaker   *BreakerPolicy
+	hedging   *HedgingPolicy
+
+	interceptors []UnaryInterceptor
+
+	// passive health checking, see WithEjection
+	ejectAfter int
+	ejection   time.Duration
+
+	// transport tuning, any of them gives the client a transport of its own
+	tuned               bool
+	dialTimeout         time.Duration
+	keepAlive           time.Duration
+	idleConnTimeout     time.Duration
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+}
+
+// Option configures a Client, see NewClient.
+type Option func(*options)
+
+// WithTimeout bounds every call whose context has no deadline of its own.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.timeout = timeout }
+}
+
+// WithDialTimeout bounds establishing a connection, 5s by default.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.dialTimeout, o.tuned = timeout, true }
+}
+
+// WithKeepAlive sets the TCP keep-alive period, 30s by default; negative disables it.
+func WithKeepAlive(period time.Duration) Option {
+	return func(o *options) { o.keepAlive, o.tuned = period, true }
+}
+
+// WithIdleConnTimeout closes connections idle for longer, 90s by default.
+func WithIdleConnTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.idleConnTimeout, o.tuned = timeout, true }
+}
+
+// WithMaxIdleConns caps idle connections kept for reuse in total and per
+// server, 1000 and 256 by default.
+func WithMaxIdleConns(total, perHost int) Option {
+	return func(o *options) { o.maxIdleConns, o.maxIdleConnsPerHost, o.tuned = total, perHost, true }
+}
+
+// WithMaxConnsPerHost caps the connections open to one server, 0 (the
+// default) means no limit.
+func WithMaxConnsPerHost(n int) Option {
+	return func(o *options) { o.maxConnsPerHost, o.tuned = n, true }
+}
+
+// WithTransport sends requests through rt instead of the shared transport;
+// the transport tuning options are then ignored.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) { o.transport = rt }
+}
+
+// WithCodec encodes calls with one of the codecs in codec.NewCodecFuncMap
+// instead of the default JSON envelope.
+func WithCodec(codecType codec.Type) Option {
+	return func(o *options) { o.codec = codecType }
+}
+
+// WithMetadata adds metadata to every call, e.g. an API key.
+func WithMetadata(metadata map[string]string) Option {
+	return func(o *options) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string, len(metadata))
+		}
+		for key, value := range metadata {
+			o.metadata[key] = value
+		}
+	}
+}
+
+// WithUserAgent replaces the User-Agent header, "rpcsimple-client" by default.
+func WithUserAgent(userAgent string) Option {
+	return func(o *options) { o.userAgent = userAgent }
+}
+
+// WithLogger replaces the logger calls are reported to, slog.Default() by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithTracer records a client span around every call; the server span
+// becomes its child. Without a tracer the caller's span context is forwarded
+// as is.
+func WithTracer(tracer *trace.Tracer) Option {
+	return func(o *options) { o.tracer = tracer }
+}
+
+// WithRetryPolicy makes the client retry failed calls.
+func WithRetryPolicy(policy *RetryPolicy) Option {
+	return func(o *options) { o.retry = policy }
+}
+
+// WithBalancer chooses how calls are spread over the client's endpoints,
+// RoundRobin() by default.
+func WithBalancer(balancer Balancer) Option {
+	return func(o *options) { o.balancer = balancer }
+}
+
+// WithEjection takes an endpoint out of rotation for ejection after
+// consecutive calls to it failed with a transport error or Unavailable, 3 and
+// 10s by default. A threshold of 0 never ejects.
+func WithEjection(consecutiveFailures int, ejection time.Duration) Option {
+	return func(o *options) { o.ejectAfter, o.ejection = consecutiveFailures, ejection }
+}
+
+// WithCircuitBreaker fails calls fast with Unavailable while the endpoint
+// they would go to keeps failing, see BreakerPolicy.
+func WithCircuitBreaker(policy *BreakerPolicy) Option {
+	return func(o *options) { o.breaker = policy }
+}
+
+// WithHedging sends copies of slow calls to other endpoints, see HedgingPolicy.
+func WithHedging(policy *HedgingPolicy) Option {
+	return func(o *options) { o.hedging = policy }
+}
+
+// WithInterceptors wraps every call in interceptors, the first one
+// outermost. Options given more than once add up.
+func WithInterceptors(interceptors ...UnaryInterceptor) Option {
+	return func(o *options) { o.interceptors = append(o.interceptors, interceptors...) }
+}
+
+func newTransport(o options) *http.Transport {
+	dialer := &net.Dialer{Timeout: o.dialTimeout, KeepAlive: o.keepAlive}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        o.maxIdleConns,
+		MaxIdleConnsPerHost: o.maxIdleConnsPerHost,
+		MaxConnsPerHost:     o.maxConnsPerHost,
+		IdleConnTimeout:     o.idleConnTimeout,
+	}
+}
+
+func defaultOptions() options {
+	return options{
+		userAgent:           defaultUserAgent,
+		dialTimeout:         5 * time.Second,
+		keepAlive:           30 * time.Second,
+		idleConnTimeout:     90 * time.Second,
+		maxIdleConns:        1000,
+		maxIdleConnsPerHost: 256,
+		ejectAfter:          3,
+		ejection:            10 * time.Second,
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.balancer == nil {
+		o.balancer = RoundRobin()
+	}
+	if o.transport == nil {
+		o.transport = defaultTransport
+		if o.tuned {
+			o.transport = newTransport(o)
+		}
+	}
+	return o
+}
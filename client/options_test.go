@@ -0,0 +1,65 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_Options(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte(`{"result":null}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(ts.URL,
+		WithMetadata(map[string]string{"x-api-key": "secret"}),
+		WithUserAgent("billing/1.0"),
+		WithTimeout(time.Second),
+		WithMaxConnsPerHost(4),
+	)
+	_assert(client.Call("Math.Add", map[string]interface{}{}, nil) == nil, "call failed")
+	_assert(header.Get("X-Api-Key") == "secret", "default metadata missing")
+	_assert(header.Get("User-Agent") == "billing/1.0", "wrong user agent %q", header.Get("User-Agent"))
+	_assert(header.Get("Rpc-Timeout-Ms") != "", "default timeout should be sent as a deadline")
+	_assert(client.httpClient.Transport != defaultTransport, "tuned client should get its own transport")
+	_assert(NewClient(ts.URL).httpClient.Transport == defaultTransport, "untuned clients should share the transport")
+}
+
+func TestClient_ReusesConnections(t *testing.T) {
+	var dials int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte(`{"result":3}`))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&dials, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	client := NewClient(ts.URL)
+	burst := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_assert(client.Call("Math.Add", map[string]interface{}{}, nil) == nil, "call failed")
+			}()
+		}
+		wg.Wait()
+	}
+	burst()
+	first := atomic.LoadInt32(&dials)
+	burst()
+	_assert(atomic.LoadInt32(&dials) == first, "second burst should reuse the %d idle connections, but dialed %d more", first, atomic.LoadInt32(&dials)-first)
+}
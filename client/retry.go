@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"path"
+	"rpcsimple/status"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed call is tried again.
+//
+// Failures the server guarantees happened before the method ran (the codes
+// in RetryableCodes, or a connection that was never established) are retried
+// for every method. Failures after which the method may have run, such as a
+// timeout or a dropped connection, are retried only for RetryableMethods, for
+// methods the server replied are Idempotent or ReadOnly (see
+// registry.MethodOptions) and for calls carrying an idempotency key.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt too; 1 or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the pause before the first retry, growing by
+	// Multiplier (2 when 0) with every retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes each pause by up to this fraction of it, e.g. 0.2.
+	Jitter float64
+	// PerAttemptTimeout bounds each attempt on top of the call's own deadline.
+	PerAttemptTimeout time.Duration
+	// RetryableCodes defaults to Unavailable and ResourceExhausted.
+	RetryableCodes []status.Code
+	// RetryableMethods lists "Service.Method" patterns as understood by
+	// path.Match, e.g. "Math.*", of methods safe to run more than once.
+	RetryableMethods []string
+	// Budget, when set, stops retrying once retries make up too large a
+	// share of the traffic, so retries can't turn an outage into a storm.
+	Budget *RetryBudget
+}
+
+var defaultRetryableCodes = []status.Code{status.Unavailable, status.ResourceExhausted}
+
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	backoff := float64(policy.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	backoff += backoff * policy.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(backoff)
+}
+
+func (policy *RetryPolicy) retryable(serviceMethod string, idempotent bool, err error) bool {
+	if errors.Is(err, ErrShutdown) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if notSent(err) {
+		return true
+	}
+	var statusErr *status.Error
+	if errors.As(err, &statusErr) {
+		codes := policy.RetryableCodes
+		if codes == nil {
+			codes = defaultRetryableCodes
+		}
+		for _, code := range codes {
+			if statusErr.Code == code {
+				return true
+			}
+		}
+		// any other code came from the server, which may have run the method;
+		// only a timeout is worth trying again, and only when that is safe
+		if statusErr.Code != status.DeadlineExceeded {
+			return false
+		}
+	}
+	return idempotent || policy.retryableMethod(serviceMethod)
+}
+
+func (policy *RetryPolicy) retryableMethod(serviceMethod string) bool {
+	for _, pattern := range policy.RetryableMethods {
+		if ok, _ := path.Match(pattern, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// notSent reports whether err means the request never reached the server,
+// e.g. connection refused while it restarts.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// RetryBudget throttles retries the way gRPC does: every failed attempt takes
+// a token, every success gives back Ratio tokens, and retries are only allowed
+// while more than half of MaxTokens are left.
+type RetryBudget struct {
+	mu        sync.Mutex
+	maxTokens float64
+	ratio     float64
+	tokens    float64
+}
+
+// NewRetryBudget allows retries until failures outnumber successes by about
+// maxTokens/2, e.g. NewRetryBudget(10, 0.1).
+func NewRetryBudget(maxTokens, ratio float64) *RetryBudget {
+	return &RetryBudget{maxTokens: maxTokens, ratio: ratio, tokens: maxTokens}
+}
+
+func (budget *RetryBudget) onSuccess() {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.tokens = math.Min(budget.maxTokens, budget.tokens+budget.ratio)
+}
+
+func (budget *RetryBudget) onFailure() {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.tokens = math.Max(0, budget.tokens-1)
+}
+
+func (budget *RetryBudget) allow() bool {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	return budget.tokens > budget.maxTokens/2
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rpcsimple/status"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// attemptLog collects the rpc-attempt metadata of the calls a server got.
+type attemptLog struct {
+	mu       sync.Mutex
+	attempts []string
+}
+
+func (l *attemptLog) add(attempt string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attempts = append(l.attempts, attempt)
+}
+
+func (l *attemptLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.attempts...)
+}
+
+// flakyServer fails the first failures calls with code, then answers 3.
+func flakyServer(failures int32, code status.Code, attempts *attemptLog) *httptest.Server {
+	var calls int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.add(r.Header.Get("rpc-attempt"))
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(code.HTTPStatus())
+			w.Write([]byte(`{"error":{"code":"` + string(code) + `","message":"try later"}}`))
+			return
+		}
+		w.Write([]byte(`{"result":3}`))
+	}))
+}
+
+func TestClient_RetryUnavailable(t *testing.T) {
+	var seen attemptLog
+	ts := flakyServer(2, status.Unavailable, &seen)
+	defer ts.Close()
+
+	client := NewClient(ts.URL, WithRetryPolicy(&RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.2}))
+	var reply int
+	request := <-client.Go("Math.Add", map[string]interface{}{}, &reply, nil).Done
+	_assert(request.Error == nil && reply == 3, "call should succeed on the third attempt: %v", request.Error)
+	_assert(request.Attempts == 3, "expect 3 attempts, but got %d", request.Attempts)
+	attempts := seen.list()
+	_assert(len(attempts) == 3 && attempts[0] == "1" && attempts[2] == "3", "wrong attempt metadata %v", attempts)
+}
+
+func TestClient_RetryClassification(t *testing.T) {
+	var seen attemptLog
+	ts := flakyServer(1, status.DeadlineExceeded, &seen)
+	defer ts.Close()
+
+	client := NewClient(ts.URL, WithRetryPolicy(&RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	err := client.Call("Math.Add", map[string]interface{}{}, nil)
+	_assert(status.CodeOf(err) == status.DeadlineExceeded && len(seen.list()) == 1, "unsafe method should not be retried: %v", err)
+
+	client = NewClient(ts.URL, WithRetryPolicy(&RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, RetryableMethods: []string{"Math.*"}}))
+	err = client.Call("Math.Add", map[string]interface{}{}, nil)
+	_assert(err == nil && len(seen.list()) == 2, "retryable method should be retried once: %v %v", err, seen.list())
+}
+
+func TestClient_RetrySafeMethods(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("rpc-safe-to-repeat", "true")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(status.DeadlineExceeded.HTTPStatus())
+			w.Write([]byte(`{"error":{"code":"DeadlineExceeded","message":"too slow"}}`))
+			return
+		}
+		w.Write([]byte(`{"result":3}`))
+	}))
+	defer ts.Close()
+
+	client := NewClient(ts.URL, WithRetryPolicy(&RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	err := client.Call("Math.Add", map[string]interface{}{}, nil)
+	_assert(err == nil && atomic.LoadInt32(&calls) == 2, "methods the server marks safe should be retried once: %v", err)
+}
+
+func TestClient_RetryConnectionRefused(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+
+	client := NewClient(url, WithRetryPolicy(&RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+	request := <-client.Go("Math.Add", map[string]interface{}{}, nil, nil).Done
+	_assert(request.Error != nil && request.Attempts == 2, "refused connections should be retried, %d attempts: %v", request.Attempts, request.Error)
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(4, 1)
+	budget.onFailure()
+	_assert(budget.allow(), "one failure should leave room for retries")
+	budget.onFailure()
+	_assert(!budget.allow(), "half the tokens gone should stop retries")
+	budget.onSuccess()
+	_assert(budget.allow(), "successes should earn retries back")
+}
@@ -0,0 +1,26 @@
+// Command discovery runs a discovery server, see package discovery.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"rpcsimple/discovery"
+	"time"
+)
+
+func main() {
+	log.SetFlags(0)
+	addr := flag.String("addr", "127.0.0.1:7946", "address to listen on")
+	ttl := flag.Duration("ttl", 30*time.Second, "drop instances missing heartbeats for this long")
+	flag.Parse()
+
+	server, err := discovery.NewServer(*ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Discovery server is running on %s", *addr)
+	err = http.ListenAndServe(*addr, server)
+	server.Close()
+	log.Fatal(err)
+}
@@ -2,11 +2,13 @@ package codec
 
 import (
 	"io"
+	"log/slog"
 )
 
 type Header struct {
-	ServiceMethod string // format "Service.Method"
-	Seq           uint64 // sequence number chosen by client
+	ServiceMethod string            // format "Service.Method"
+	Seq           uint64            // sequence number chosen by client
+	Metadata      map[string]string // e.g. W3C trace context, see package trace
 	Error         string
 }
 
@@ -27,6 +29,21 @@ const (
 	HttpType Type = "application/http"
 )
 
+// Well-known metadata keys. Over HTTP they travel as headers of the same name.
+const (
+	MetadataIdempotencyKey = "idempotency-key"
+	// MetadataTimeout is the time left until the caller's deadline, in milliseconds.
+	MetadataTimeout = "rpc-timeout-ms"
+	// MetadataAttempt numbers the attempts of a retried call from 1.
+	MetadataAttempt = "rpc-attempt"
+	// MetadataVersion selects the version of the service called, e.g. "v2",
+	// unless the service method names one as in "Math@v2.Add".
+	MetadataVersion = "rpc-version"
+	// MetadataSafeToRepeat is set to "true" by the server on replies of
+	// methods marked Idempotent or ReadOnly, which clients may retry.
+	MetadataSafeToRepeat = "rpc-safe-to-repeat"
+)
+
 var NewCodecFuncMap map[Type]NewCodecFunc
 
 func init() {
@@ -34,3 +51,30 @@ func init() {
 	NewCodecFuncMap[GobType] = NewGobCodec
 	NewCodecFuncMap[HttpType] = NewHttpCodec
 }
+
+var logger *slog.Logger
+
+// SetLogger replaces the logger codec errors are reported to, slog.Default() by default.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+func getLogger() *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+type conn struct {
+	io.Reader
+	io.Writer
+}
+
+func (conn) Close() error { return nil }
+
+// Conn adapts a reader and a writer to the connection codecs expect, for
+// transports such as HTTP that carry one message in each direction.
+func Conn(r io.Reader, w io.Writer) io.ReadWriteCloser {
+	return conn{Reader: r, Writer: w}
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"encoding/gob"
 	"io"
-	"log"
 )
 
 type GobCodec struct {
@@ -42,11 +41,11 @@ func (c *GobCodec) Write(header *Header, body interface{}) (err error) {
 		}
 	}()
 	if err = c.enc.Encode(header); err != nil {
-		log.Println("rpc: gob error encoding header:", err)
+		getLogger().Error("rpc: gob error encoding header", "error", err)
 		return
 	}
 	if err = c.enc.Encode(body); err != nil {
-		log.Println("rpc: gob error encoding body:", err)
+		getLogger().Error("rpc: gob error encoding body", "error", err)
 		return
 	}
 	return
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"encoding/json"
 	"io"
-	"log"
 )
 
 type HttpCodec struct {
@@ -42,11 +41,11 @@ func (c *HttpCodec) Write(header *Header, body interface{}) (err error) {
 		}
 	}()
 	if err = c.enc.Encode(header); err != nil {
-		log.Println("rpc: http error encoding header:", err)
+		getLogger().Error("rpc: http error encoding header", "error", err)
 		return
 	}
 	if err = c.enc.Encode(body); err != nil {
-		log.Println("rpc: http error encoding body:", err)
+		getLogger().Error("rpc: http error encoding body", "error", err)
 		return
 	}
 	return
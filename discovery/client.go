@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"rpcsimple/registry"
+	"rpcsimple/status"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a discovery Server over HTTP.
+type Client struct {
+	url        string
+	httpClient *http.Client
+	logger     *slog.Logger
+}
+
+// NewClient returns a client of the discovery server at baseURL, e.g.
+// "http://127.0.0.1:7946".
+func NewClient(baseURL string) *Client {
+	return &Client{url: strings.TrimSuffix(baseURL, "/"), httpClient: &http.Client{}}
+}
+
+// SetLogger replaces the logger Announce reports to, slog.Default() by default.
+func (c *Client) SetLogger(logger *slog.Logger) {
+	c.logger = logger
+}
+
+func (c *Client) getLogger() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
+func (c *Client) Register(ctx context.Context, instance Instance) error {
+	return c.post(ctx, "/register", instance)
+}
+
+func (c *Client) Heartbeat(ctx context.Context, addr string) error {
+	return c.post(ctx, "/heartbeat", addrBody{Addr: addr})
+}
+
+func (c *Client) Deregister(ctx context.Context, addr string) error {
+	return c.post(ctx, "/deregister", addrBody{Addr: addr})
+}
+
+// Instances returns the instances currently serving service.
+func (c *Client) Instances(ctx context.Context, service string) (Instances, error) {
+	return c.get(ctx, url.Values{"service": {service}})
+}
+
+// Watch long-polls for the instances of service to differ from version,
+// answering with them as they are after at most wait.
+func (c *Client) Watch(ctx context.Context, service string, version uint64, wait time.Duration) (Instances, error) {
+	return c.get(ctx, url.Values{
+		"service": {service},
+		"version": {strconv.FormatUint(version, 10)},
+		"wait":    {wait.String()},
+	})
+}
+
+// Announce registers instance and sends a heartbeat every interval, which
+// should be well under the server's TTL, until ctx is done; it then
+// deregisters the instance. An instance that expired anyway, e.g. after a
+// network partition, registers again. RPC servers run it alongside Start:
+//
+//	instance := discovery.Instance{Addr: "http://10.0.0.7:9999/call", Services: discovery.ServiceNames(r)}
+//	go discovery.NewClient("http://discovery:7946").Announce(ctx, instance, 10*time.Second)
+func (c *Client) Announce(ctx context.Context, instance Instance, interval time.Duration) error {
+	registered := false
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		if registered {
+			err = c.Heartbeat(ctx, instance.Addr)
+			if status.CodeOf(err) == status.NotFound {
+				registered = false
+			}
+		}
+		if !registered {
+			err = c.Register(ctx, instance)
+			registered = err == nil
+		}
+		if err != nil && ctx.Err() == nil {
+			c.getLogger().Warn("discovery: announce failed", "addr", instance.Addr, "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// ctx is done, give deregistering a moment of its own
+			deregisterCtx, cancel := context.WithTimeout(context.Background(), interval)
+			defer cancel()
+			return c.Deregister(deregisterCtx, instance.Addr)
+		}
+	}
+}
+
+// ServiceNames lists the services of r, for Instance.Services, once
+// whatever the number of their versions.
+func ServiceNames(r *registry.Registry) []string {
+	var names []string
+	for _, info := range r.Services() {
+		// Services sorts the versions of a service next to each other
+		if len(names) == 0 || names[len(names)-1] != info.Name {
+			names = append(names, info.Name)
+		}
+	}
+	return names
+}
+
+func (c *Client) post(ctx context.Context, path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = c.do(req)
+	return err
+}
+
+func (c *Client) get(ctx context.Context, query url.Values) (Instances, error) {
+	var instances Instances
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/instances?"+query.Encode(), nil)
+	if err != nil {
+		return instances, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return instances, err
+	}
+	err = json.Unmarshal(body, &instances)
+	return instances, err
+}
+
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errorBody struct {
+			Error *status.Error `json:"error"`
+		}
+		if json.Unmarshal(body, &errorBody) == nil && errorBody.Error != nil {
+			return nil, errorBody.Error
+		}
+		return nil, status.New(status.FromHTTPStatus(resp.StatusCode), "discovery: "+resp.Status)
+	}
+	return body, nil
+}
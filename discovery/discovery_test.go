@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"rpcsimple/status"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func newTestDiscovery(t *testing.T, ttl time.Duration) (*Server, *Client) {
+	server, err := NewServer(ttl)
+	_assert(err == nil, "failed to create discovery server: %v", err)
+	ts := httptest.NewServer(server)
+	t.Cleanup(func() {
+		ts.Close()
+		server.Close()
+	})
+	return server, NewClient(ts.URL)
+}
+
+func TestNewServer(t *testing.T) {
+	_, err := NewServer(0)
+	_assert(err != nil, "a ttl of 0 should be rejected")
+	server, err := NewServer(time.Minute)
+	_assert(err == nil, "failed to create discovery server: %v", err)
+	_assert(server.Close() == nil && server.Close() == nil, "Close should be safe to call twice")
+}
+
+func TestDiscovery_RegisterAndExpire(t *testing.T) {
+	_, c := newTestDiscovery(t, 100*time.Millisecond)
+	ctx := context.Background()
+	_assert(c.Register(ctx, Instance{Addr: "http://a/call", Services: []string{"Math", "Clock"}}) == nil, "failed to register a")
+	_assert(c.Register(ctx, Instance{Addr: "http://b/call", Services: []string{"Math"}, Weight: 2}) == nil, "failed to register b")
+
+	math, err := c.Instances(ctx, "Math")
+	_assert(err == nil && len(math.Instances) == 2, "expect 2 Math instances, but got %v: %v", math.Instances, err)
+	_assert(math.Instances[1].Weight == 2 && !math.Instances[1].LastHeartbeat.IsZero(), "wrong instance %+v", math.Instances[1])
+	clock, _ := c.Instances(ctx, "Clock")
+	_assert(len(clock.Instances) == 1 && clock.Instances[0].Addr == "http://a/call", "wrong Clock instances %v", clock.Instances)
+
+	// a keeps beating, b goes silent
+	for i := 0; i < 6; i++ {
+		time.Sleep(40 * time.Millisecond)
+		_assert(c.Heartbeat(ctx, "http://a/call") == nil, "heartbeat of a failed")
+	}
+	math, _ = c.Instances(ctx, "Math")
+	_assert(len(math.Instances) == 1 && math.Instances[0].Addr == "http://a/call", "b should have expired, got %v", math.Instances)
+	err = c.Heartbeat(ctx, "http://b/call")
+	_assert(status.CodeOf(err) == status.NotFound, "expect NotFound for an expired instance, but got %v", err)
+
+	_assert(c.Deregister(ctx, "http://a/call") == nil, "failed to deregister a")
+	math, _ = c.Instances(ctx, "Math")
+	_assert(len(math.Instances) == 0, "a should be gone, got %v", math.Instances)
+	_, err = c.Instances(ctx, "")
+	_assert(status.CodeOf(err) == status.InvalidArgument, "a service is required, got %v", err)
+}
+
+func TestDiscovery_Watch(t *testing.T) {
+	server, c := newTestDiscovery(t, time.Minute)
+	ctx := context.Background()
+	server.Register(Instance{Addr: "http://a/call", Services: []string{"Math"}})
+	current, _ := c.Instances(ctx, "Math")
+
+	watched := make(chan Instances)
+	go func() {
+		instances, err := c.Watch(ctx, "Math", current.Version, 5*time.Second)
+		_assert(err == nil, "watch failed: %v", err)
+		watched <- instances
+	}()
+	time.Sleep(20 * time.Millisecond)
+	server.Register(Instance{Addr: "http://x/call", Services: []string{"Clock"}}) // not a Math change
+	start := time.Now()
+	server.Register(Instance{Addr: "http://b/call", Services: []string{"Math"}})
+	instances := <-watched
+	_assert(time.Since(start) < time.Second, "watch should return on the change")
+	_assert(instances.Version > current.Version && len(instances.Instances) == 2, "wrong instances after the change %+v", instances)
+
+	start = time.Now()
+	same, err := c.Watch(ctx, "Math", instances.Version, 50*time.Millisecond)
+	_assert(err == nil && same.Version == instances.Version, "watch without changes should return the same version: %v", err)
+	_assert(time.Since(start) >= 50*time.Millisecond, "watch should wait for changes")
+}
+
+func TestDiscovery_Announce(t *testing.T) {
+	server, c := newTestDiscovery(t, 100*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Announce(ctx, Instance{Addr: "http://a/call", Services: []string{"Math"}}, 20*time.Millisecond)
+	}()
+	time.Sleep(250 * time.Millisecond)
+	_assert(len(server.Instances("Math").Instances) == 1, "heartbeats should keep the instance alive")
+
+	// an instance dropped anyway registers again
+	server.Deregister("http://a/call")
+	time.Sleep(50 * time.Millisecond)
+	_assert(len(server.Instances("Math").Instances) == 1, "the instance should register again")
+
+	cancel()
+	_assert(<-done == nil, "announce should deregister cleanly")
+	_assert(len(server.Instances("Math").Instances) == 0, "the instance should deregister on shutdown")
+}
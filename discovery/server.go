@@ -0,0 +1,333 @@
+// Package discovery keeps track of the RPC servers that are up and the
+// services they serve. RPC servers announce themselves to a discovery Server
+// and keep their entry alive with heartbeats; clients ask it, or long-poll
+// it, for the instances of a service.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"rpcsimple/status"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Instance is one RPC server as known to discovery.
+type Instance struct {
+	// Addr is the URL of the server's call endpoint, e.g.
+	// "http://10.0.0.7:9999/call", and identifies the instance.
+	Addr     string            `json:"addr"`
+	Services []string          `json:"services"`
+	Weight   int               `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// LastHeartbeat is set by the discovery server.
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+}
+
+func (instance *Instance) serves(service string) bool {
+	for _, s := range instance.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Instances is the answer to a query: the instances of a service and the
+// version of that list, to be passed back when long-polling for changes.
+type Instances struct {
+	Version   uint64     `json:"version"`
+	Instances []Instance `json:"instances"`
+}
+
+// maxWait bounds a long-poll, so proxies don't cut it first.
+const maxWait = time.Minute
+
+// Server is the discovery server. It is an http.Handler serving
+//
+//	POST /register    an Instance, replacing any entry with the same Addr
+//	POST /heartbeat   {"addr": ...}, NotFound when the entry expired
+//	POST /deregister  {"addr": ...}
+//	GET  /instances?service=Math[&version=N&wait=30s]
+//
+// /instances answers right away unless version is given: it then waits, up
+// to wait, for the list to differ from version N.
+type Server struct {
+	ttl    time.Duration
+	logger *slog.Logger
+	mux    *http.ServeMux
+
+	mu        sync.Mutex
+	instances map[string]*Instance
+	version   uint64            // bumped on every change
+	versions  map[string]uint64 // version of the last change per service
+	changed   chan struct{}     // closed and replaced on every change
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewServer returns a discovery server dropping instances that missed their
+// heartbeats for ttl, which must be positive. Close stops its reaper.
+func NewServer(ttl time.Duration) (*Server, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("discovery: invalid ttl %v", ttl)
+	}
+	server := &Server{
+		ttl:       ttl,
+		instances: make(map[string]*Instance),
+		versions:  make(map[string]uint64),
+		changed:   make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+	server.mux = http.NewServeMux()
+	server.mux.HandleFunc("/register", server.handleRegister)
+	server.mux.HandleFunc("/heartbeat", server.handleHeartbeat)
+	server.mux.HandleFunc("/deregister", server.handleDeregister)
+	server.mux.HandleFunc("/instances", server.handleInstances)
+	go server.reap()
+	return server, nil
+}
+
+// SetLogger replaces the logger changes are reported to, slog.Default() by default.
+func (server *Server) SetLogger(logger *slog.Logger) {
+	server.logger = logger
+}
+
+func (server *Server) getLogger() *slog.Logger {
+	if server.logger == nil {
+		return slog.Default()
+	}
+	return server.logger
+}
+
+// Close stops expiring instances. Closing again does nothing.
+func (server *Server) Close() error {
+	server.stopOnce.Do(func() { close(server.stop) })
+	return nil
+}
+
+// Register adds the instance, or replaces the one with the same Addr, and
+// counts as its first heartbeat.
+func (server *Server) Register(instance Instance) error {
+	if instance.Addr == "" {
+		return status.New(status.InvalidArgument, "discovery: instance has no addr")
+	}
+	instance.Services = append([]string(nil), instance.Services...)
+	instance.LastHeartbeat = time.Now()
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	old := server.instances[instance.Addr]
+	server.instances[instance.Addr] = &instance
+	server.changedLocked(old, &instance)
+	server.getLogger().Info("discovery: register", "addr", instance.Addr, "services", instance.Services)
+	return nil
+}
+
+// Heartbeat keeps the instance at addr alive for another ttl. It fails with
+// NotFound once the instance expired; the instance should register again.
+func (server *Server) Heartbeat(addr string) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	instance, ok := server.instances[addr]
+	if !ok {
+		return status.Errorf(status.NotFound, "discovery: %s is not registered", addr)
+	}
+	instance.LastHeartbeat = time.Now()
+	return nil
+}
+
+// Deregister removes the instance at addr, e.g. when it shuts down.
+func (server *Server) Deregister(addr string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if old, ok := server.instances[addr]; ok {
+		delete(server.instances, addr)
+		server.changedLocked(old, nil)
+		server.getLogger().Info("discovery: deregister", "addr", addr)
+	}
+}
+
+// Instances returns the instances serving service, sorted by Addr.
+func (server *Server) Instances(service string) Instances {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.instancesLocked(service)
+}
+
+// Watch waits until the instances of service differ from version, or until
+// ctx is done, and returns them as they are then.
+func (server *Server) Watch(ctx context.Context, service string, version uint64) Instances {
+	for {
+		server.mu.Lock()
+		if server.versions[service] > version {
+			defer server.mu.Unlock()
+			return server.instancesLocked(service)
+		}
+		changed := server.changed
+		server.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return server.Instances(service)
+		}
+	}
+}
+
+func (server *Server) instancesLocked(service string) Instances {
+	result := Instances{Version: server.versions[service], Instances: []Instance{}}
+	for _, instance := range server.instances {
+		if instance.serves(service) {
+			result.Instances = append(result.Instances, *instance)
+		}
+	}
+	sort.Slice(result.Instances, func(i, j int) bool { return result.Instances[i].Addr < result.Instances[j].Addr })
+	return result
+}
+
+// changedLocked records that old was replaced by instance, either may be
+// nil, and wakes the watchers.
+func (server *Server) changedLocked(old, instance *Instance) {
+	server.version++
+	for _, changed := range []*Instance{old, instance} {
+		if changed == nil {
+			continue
+		}
+		for _, service := range changed.Services {
+			server.versions[service] = server.version
+		}
+	}
+	close(server.changed)
+	server.changed = make(chan struct{})
+}
+
+func (server *Server) reap() {
+	ticker := time.NewTicker(server.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			server.expire(time.Now())
+		case <-server.stop:
+			return
+		}
+	}
+}
+
+func (server *Server) expire(now time.Time) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for addr, instance := range server.instances {
+		if now.Sub(instance.LastHeartbeat) > server.ttl {
+			delete(server.instances, addr)
+			server.changedLocked(instance, nil)
+			server.getLogger().Warn("discovery: expire", "addr", addr, "last_heartbeat", instance.LastHeartbeat)
+		}
+	}
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+type addrBody struct {
+	Addr string `json:"addr"`
+}
+
+func (server *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var instance Instance
+	if !decodeBody(w, r, &instance) {
+		return
+	}
+	writeResult(w, server.Register(instance))
+}
+
+func (server *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var body addrBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	writeResult(w, server.Heartbeat(body.Addr))
+}
+
+func (server *Server) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	var body addrBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	server.Deregister(body.Addr)
+	writeResult(w, nil)
+}
+
+func (server *Server) handleInstances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	service := query.Get("service")
+	if service == "" {
+		writeError(w, status.New(status.InvalidArgument, "discovery: service is required"))
+		return
+	}
+	if query.Get("version") == "" {
+		writeJSON(w, server.Instances(service))
+		return
+	}
+	version, err := strconv.ParseUint(query.Get("version"), 10, 64)
+	if err != nil {
+		writeError(w, status.Errorf(status.InvalidArgument, "discovery: invalid version: %v", err))
+		return
+	}
+	wait := 30 * time.Second
+	if query.Get("wait") != "" {
+		if wait, err = time.ParseDuration(query.Get("wait")); err != nil {
+			writeError(w, status.Errorf(status.InvalidArgument, "discovery: invalid wait: %v", err))
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), min(wait, maxWait))
+	defer cancel()
+	writeJSON(w, server.Watch(ctx, service, version))
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are supported", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, status.Errorf(status.InvalidArgument, "discovery: failed to parse request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, status.Convert(err))
+		return
+	}
+	writeJSON(w, struct{}{})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, status.Errorf(status.Internal, "discovery: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, err *status.Error) {
+	body, _ := json.Marshal(map[string]*status.Error{"error": err})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Code.HTTPStatus())
+	w.Write(body)
+}
@@ -2,8 +2,9 @@ module rpcsimple
 
 go 1.22.3
 
+require github.com/panjf2000/ants/v2 v2.10.0
+
 require (
-	github.com/panjf2000/ants/v2 v2.10.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
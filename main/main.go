@@ -34,7 +34,7 @@ func (m *Math) AddString(args Args2, reply *string) error {
 }
 
 func call(addr string, ctx server.Context) (int, error) {
-	log.Printf("Calling rpc %s with args %v", ctx.ServiceMethod, ctx.Args)
+	log.Printf("Calling rpc %s with args %s", ctx.ServiceMethod, ctx.Args)
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(ctx); err != nil {
 		return 0, fmt.Errorf("failed to encode request: %v", err)
@@ -60,7 +60,9 @@ func main() {
 
 	var mathService Math
 	r := registry.NewRegistry()
-	r.Register(&mathService)
+	if err := r.Register(&mathService); err != nil {
+		log.Fatal(err)
+	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -74,8 +76,11 @@ func main() {
 	args := make(map[string]interface{})
 	args["A"] = "hello"
 	args["B"] = "world"
-	response := client.Call("Math.AddString", args)
-	log.Printf("Response: %v", response.Result)
+	var reply string
+	if err := client.Call("Math.AddString", args, &reply); err != nil {
+		log.Fatalf("Call failed: %v", err)
+	}
+	log.Printf("Response: %v", reply)
 
 	select {}
 
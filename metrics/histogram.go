@@ -0,0 +1,92 @@
+// Package metrics holds the measurements shared by the client and the server.
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the histogram buckets, doubling from
+// 100µs to roughly 52s. Anything slower falls into the overflow bucket.
+var latencyBuckets = func() []time.Duration {
+	bounds := make([]time.Duration, 20)
+	bound := 100 * time.Microsecond
+	for i := range bounds {
+		bounds[i] = bound
+		bound *= 2
+	}
+	return bounds
+}()
+
+// Histogram is a lock-free, fixed-bucket latency histogram.
+type Histogram struct {
+	counts [21]uint64 // len(latencyBuckets) + overflow
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	var total uint64
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+	}
+	return total
+}
+
+// Quantile estimates the q-th quantile (0 < q <= 1) by linear interpolation
+// inside the bucket that holds it. It returns 0 when nothing was observed.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	var counts [21]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen uint64
+	for i, c := range counts {
+		if c == 0 || float64(seen+c) < rank {
+			seen += c
+			continue
+		}
+		if i == len(latencyBuckets) {
+			return latencyBuckets[i-1]
+		}
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		frac := (rank - float64(seen)) / float64(c)
+		return lower + time.Duration(frac*float64(latencyBuckets[i]-lower))
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// Reset forgets every observation.
+func (h *Histogram) Reset() {
+	h.Take(true)
+}
+
+// Take returns a copy of the histogram, emptying it when reset is set.
+// Observations racing with it land in either the copy or h, never both.
+func (h *Histogram) Take(reset bool) *Histogram {
+	taken := new(Histogram)
+	for i := range h.counts {
+		if reset {
+			taken.counts[i] = atomic.SwapUint64(&h.counts[i], 0)
+		} else {
+			taken.counts[i] = atomic.LoadUint64(&h.counts[i])
+		}
+	}
+	return taken
+}
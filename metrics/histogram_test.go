@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestHistogram_Quantile(t *testing.T) {
+	var h Histogram
+	_assert(h.Quantile(0.5) == 0, "empty histogram should report 0")
+	for i := 0; i < 99; i++ {
+		h.Observe(150 * time.Microsecond)
+	}
+	h.Observe(time.Second)
+	p50 := h.Quantile(0.5)
+	_assert(p50 > 100*time.Microsecond && p50 <= 200*time.Microsecond, "wrong p50 %v", p50)
+	p100 := h.Quantile(1)
+	_assert(p100 > 800*time.Millisecond && p100 <= 1700*time.Millisecond, "wrong p100 %v", p100)
+}
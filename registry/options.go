@@ -0,0 +1,263 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// MethodOptions are the settings a method is served with. The zero value
+// serves it without any limit.
+type MethodOptions struct {
+	// DefaultTimeout bounds calls whose caller set no deadline.
+	DefaultTimeout time.Duration
+	// MaxTimeout bounds every call, whatever deadline the caller set.
+	MaxTimeout time.Duration
+	// MaxArgsSize rejects calls whose encoded arguments are larger, in bytes.
+	// The whole body counts for requests in a codec.
+	MaxArgsSize int
+	// Idempotent marks methods that can safely run more than once for the
+	// same call. The server says so on every reply, and clients retry them
+	// after a timeout as they do keyed calls, see client.RetryPolicy.
+	Idempotent bool
+	// ReadOnly marks methods that change nothing, and so are idempotent too.
+	ReadOnly bool
+	// CacheTTL, for ReadOnly methods only, answers calls from the same
+	// principal with the same JSON arguments from a cache of the successful
+	// replies for that long.
+	CacheTTL time.Duration
+	// Scopes are all required of the caller, see server.SetScopeFunc.
+	Scopes []string
+	// RateLimit is the number of calls per second served, 0 means no limit.
+	// RateBurst calls may come at once, at least 1 and by default RateLimit
+	// rounded up.
+	RateLimit float64
+	RateBurst int
+	// Deprecated, when set, tells callers what to use instead.
+	Deprecated string
+	// StrictArgs rejects JSON arguments with unknown fields or missing
+	// required ones, see server.SetStrictArgs.
+	StrictArgs bool
+}
+
+// merge returns o with the fields set in override replacing its own.
+func (o MethodOptions) merge(override MethodOptions) MethodOptions {
+	if override.DefaultTimeout != 0 {
+		o.DefaultTimeout = override.DefaultTimeout
+	}
+	if override.MaxTimeout != 0 {
+		o.MaxTimeout = override.MaxTimeout
+	}
+	if override.MaxArgsSize != 0 {
+		o.MaxArgsSize = override.MaxArgsSize
+	}
+	o.Idempotent = o.Idempotent || override.Idempotent
+	o.ReadOnly = o.ReadOnly || override.ReadOnly
+	if override.CacheTTL != 0 {
+		o.CacheTTL = override.CacheTTL
+	}
+	if override.Scopes != nil {
+		o.Scopes = append([]string(nil), override.Scopes...)
+	}
+	if override.RateLimit != 0 {
+		o.RateLimit, o.RateBurst = override.RateLimit, override.RateBurst
+	}
+	if override.Deprecated != "" {
+		o.Deprecated = override.Deprecated
+	}
+	o.StrictArgs = o.StrictArgs || override.StrictArgs
+	return o
+}
+
+func (o MethodOptions) validate() error {
+	switch {
+	case o.DefaultTimeout < 0 || o.MaxTimeout < 0:
+		return fmt.Errorf("negative timeout")
+	case o.MaxTimeout > 0 && o.DefaultTimeout > o.MaxTimeout:
+		return fmt.Errorf("default timeout %v exceeds max timeout %v", o.DefaultTimeout, o.MaxTimeout)
+	case o.CacheTTL < 0:
+		return fmt.Errorf("negative cache TTL")
+	case o.CacheTTL > 0 && !o.ReadOnly:
+		return fmt.Errorf("cache TTL set for a method that is not read-only")
+	case o.MaxArgsSize < 0:
+		return fmt.Errorf("negative max args size")
+	case o.RateLimit < 0 || o.RateBurst < 0:
+		return fmt.Errorf("negative rate limit")
+	}
+	return nil
+}
+
+// SafeToRepeat reports whether the method may run again for the same call.
+func (o MethodOptions) SafeToRepeat() bool {
+	return o.Idempotent || o.ReadOnly
+}
+
+// methodOptionsJSON is how MethodOptions look in introspection output, with
+// durations as strings such as "1.5s" and the fields not set left out.
+type methodOptionsJSON struct {
+	DefaultTimeout string   `json:"defaultTimeout,omitempty"`
+	MaxTimeout     string   `json:"maxTimeout,omitempty"`
+	MaxArgsSize    int      `json:"maxArgsSize,omitempty"`
+	Idempotent     bool     `json:"idempotent,omitempty"`
+	ReadOnly       bool     `json:"readOnly,omitempty"`
+	CacheTTL       string   `json:"cacheTTL,omitempty"`
+	Scopes         []string `json:"scopes,omitempty"`
+	RateLimit      float64  `json:"rateLimit,omitempty"`
+	RateBurst      int      `json:"rateBurst,omitempty"`
+	Deprecated     string   `json:"deprecated,omitempty"`
+	StrictArgs     bool     `json:"strictArgs,omitempty"`
+}
+
+func (o MethodOptions) MarshalJSON() ([]byte, error) {
+	out := methodOptionsJSON{
+		MaxArgsSize: o.MaxArgsSize,
+		Idempotent:  o.Idempotent,
+		ReadOnly:    o.ReadOnly,
+		Scopes:      o.Scopes,
+		RateLimit:   o.RateLimit,
+		RateBurst:   o.RateBurst,
+		Deprecated:  o.Deprecated,
+		StrictArgs:  o.StrictArgs,
+	}
+	if o.DefaultTimeout > 0 {
+		out.DefaultTimeout = o.DefaultTimeout.String()
+	}
+	if o.MaxTimeout > 0 {
+		out.MaxTimeout = o.MaxTimeout.String()
+	}
+	if o.CacheTTL > 0 {
+		out.CacheTTL = o.CacheTTL.String()
+	}
+	return json.Marshal(out)
+}
+
+func (o *MethodOptions) UnmarshalJSON(data []byte) error {
+	var in methodOptionsJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*o = MethodOptions{
+		MaxArgsSize: in.MaxArgsSize,
+		Idempotent:  in.Idempotent,
+		ReadOnly:    in.ReadOnly,
+		Scopes:      in.Scopes,
+		RateLimit:   in.RateLimit,
+		RateBurst:   in.RateBurst,
+		Deprecated:  in.Deprecated,
+		StrictArgs:  in.StrictArgs,
+	}
+	for _, d := range []struct {
+		s   string
+		dst *time.Duration
+	}{{in.DefaultTimeout, &o.DefaultTimeout}, {in.MaxTimeout, &o.MaxTimeout}, {in.CacheTTL, &o.CacheTTL}} {
+		if d.s == "" {
+			continue
+		}
+		var err error
+		if *d.dst, err = time.ParseDuration(d.s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Option configures a registration.
+type Option func(*registerOptions)
+
+type registerOptions struct {
+	version string
+	service MethodOptions
+	methods map[string]MethodOptions
+}
+
+// WithOptions sets the options of every method of the service.
+func WithOptions(opts MethodOptions) Option {
+	return func(o *registerOptions) { o.service = o.service.merge(opts) }
+}
+
+// WithMethodOptions sets the options of one method, on top of those given
+// WithOptions for the whole service.
+func WithMethodOptions(method string, opts MethodOptions) Option {
+	return func(o *registerOptions) {
+		if o.methods == nil {
+			o.methods = make(map[string]MethodOptions)
+		}
+		o.methods[method] = o.methods[method].merge(opts)
+	}
+}
+
+func newRegisterOptions(opts []Option) *registerOptions {
+	o := new(registerOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// apply sets the options of the service's methods, failing for options of
+// methods it doesn't have.
+func (o *registerOptions) apply(service *Service) error {
+	for name := range o.methods {
+		if _, ok := service.method[name]; !ok {
+			return &RegisterError{Service: service.name, Reason: "options for unknown method " + name}
+		}
+	}
+	for name, m := range service.method {
+		if err := m.setOptions(o.service.merge(o.methods[name])); err != nil {
+			return &RegisterError{Service: service.name, Reason: name + ": " + err.Error()}
+		}
+	}
+	return nil
+}
+
+func (m *MethodEntry) setOptions(opts MethodOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	m.Options = opts
+	if opts.RateLimit > 0 {
+		burst := opts.RateBurst
+		if burst < 1 {
+			burst = int(math.Max(1, math.Ceil(opts.RateLimit)))
+		}
+		m.limiter = &rateLimiter{rate: opts.RateLimit, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	}
+	return nil
+}
+
+// Allow takes a token for one call from the method's rate limit, reporting
+// false when there is none left.
+func (m *MethodEntry) Allow() bool {
+	if m.limiter == nil {
+		return true
+	}
+	return m.limiter.allow(time.Now())
+}
+
+// rateLimiter is a token bucket refilled at rate tokens per second.
+type rateLimiter struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (o MethodOptions) isZero() bool {
+	return reflect.ValueOf(o).IsZero()
+}
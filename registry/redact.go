@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Redacted replaces the value of every sensitive field.
+const Redacted = "[REDACTED]"
+
+// Redact converts v into plain maps and slices keyed by json names, with the
+// value of every struct field tagged `rpc:"sensitive"`, and of every field or
+// map key listed in fields, replaced by Redacted. The result is meant for
+// logs, never for decoding back.
+func Redact(v interface{}, fields ...string) interface{} {
+	extra := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		extra[f] = true
+	}
+	return redact(reflect.ValueOf(v), extra)
+}
+
+func redact(v reflect.Value, extra map[string]bool) interface{} {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	if v.Type() == rawMessageType || v.Type() == timeType {
+		return v.Interface()
+	}
+	if _, ok := v.Interface().(json.Marshaler); ok && v.Kind() != reflect.Struct {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redact(v.Elem(), extra)
+	case reflect.Struct:
+		out := make(map[string]interface{})
+		redactFields(v, extra, out)
+		return out
+	case reflect.Map:
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := stringKey(iter.Key())
+			if extra[key] {
+				out[key] = Redacted
+				continue
+			}
+			out[key] = redact(iter.Value(), extra)
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Type() == bytesType {
+			return v.Interface()
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = redact(v.Index(i), extra)
+		}
+		return out
+	}
+	return v.Interface()
+}
+
+func redactFields(v reflect.Value, extra map[string]bool, out map[string]interface{}) {
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+		if field.Anonymous && name == "" {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				redactFields(fv, extra, out)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if field.Tag.Get("rpc") == "sensitive" || extra[name] {
+			out[name] = Redacted
+			continue
+		}
+		out[name] = redact(fv, extra)
+	}
+}
+
+func stringKey(key reflect.Value) string {
+	if key.Kind() == reflect.String {
+		return key.String()
+	}
+	b, _ := json.Marshal(key.Interface())
+	return strings.Trim(string(b), `"`)
+}
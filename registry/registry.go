@@ -1,25 +1,45 @@
 package registry
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"go/ast"
-	"log"
+	"log/slog"
 	"reflect"
+	"rpcsimple/status"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type MethodEntry struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
-	numCalls  uint64
+	fn           reflect.Value // a method bound to its service, or a plain function
+	hasContext   bool          // first argument is a context.Context
+	returnsReply bool          // returns (Reply, error) instead of filling in *Reply
+	ArgType      reflect.Type
+	ReplyType    reflect.Type // always a pointer, *Reply for methods returning Reply
+	Options      MethodOptions
+	limiter      *rateLimiter // nil without a rate limit
+	methodCounters
 }
 
 func (m *MethodEntry) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *MethodEntry) NumErrors() uint64 {
+	return atomic.LoadUint64(&m.numErrors)
+}
+
+// Latency estimates the q-th quantile of the call latency, e.g. 0.99 for p99.
+func (m *MethodEntry) Latency(q float64) time.Duration {
+	return m.latency.Quantile(q)
+}
+
 func (m *MethodEntry) NewArgv() reflect.Value {
 	var argv reflect.Value
 	// arg may be a pointer type, or a value type
@@ -45,54 +65,218 @@ func (m *MethodEntry) NewReplyv() reflect.Value {
 
 type Service struct {
 	name       string
+	version    string // "" for a service registered without one
+	seq        uint64 // registration order, kept by Replace
 	typ        reflect.Type
 	serviceObj reflect.Value
 	method     map[string]*MethodEntry
+	skipped    []SkippedMethod
+	logger     *slog.Logger // reports panicking methods
+}
+
+func (service *Service) Name() string {
+	return service.name
+}
+
+// SkippedMethod is an exported method registration left out, and why.
+type SkippedMethod struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
 }
 
-func newService(serviceObj interface{}) *Service {
+// RegisterError explains why a service couldn't be registered. Skipped lists
+// the exported methods that were not eligible when none was; a service with
+// some eligible methods registers, warns about its skipped ones and lists
+// them in ServiceInfo.
+type RegisterError struct {
+	Service string
+	Reason  string
+	Skipped []SkippedMethod
+}
+
+func (e *RegisterError) Error() string {
+	var b strings.Builder
+	b.WriteString("registry: " + e.Service + ": " + e.Reason)
+	for _, m := range e.Skipped {
+		b.WriteString("; " + m.Name + ": " + m.Reason)
+	}
+	return b.String()
+}
+
+// newService inspects serviceObj. name is the service name, the type name of
+// serviceObj when empty.
+func newService(serviceObj interface{}, name string, logger *slog.Logger) (*Service, error) {
+	if serviceObj == nil {
+		return nil, &RegisterError{Service: name, Reason: "service is nil"}
+	}
+	if v := reflect.ValueOf(serviceObj); v.Kind() == reflect.Ptr && v.IsNil() {
+		if name == "" {
+			name = v.Type().Elem().Name()
+		}
+		return nil, &RegisterError{Service: name, Reason: "service is a nil " + v.Type().String()}
+	}
 	service := new(Service)
 	service.serviceObj = reflect.ValueOf(serviceObj)
-	service.name = reflect.Indirect(service.serviceObj).Type().Name()
 	service.typ = reflect.TypeOf(serviceObj)
-	if !ast.IsExported(service.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", service.name)
+	typeName := reflect.Indirect(service.serviceObj).Type().Name()
+	if name == "" {
+		if !ast.IsExported(typeName) {
+			return nil, &RegisterError{Service: typeName, Reason: "type " + service.typ.String() + " is not exported, use RegisterName"}
+		}
+		name = typeName
+	}
+	if !validServiceName(name) {
+		return nil, &RegisterError{Service: name, Reason: "invalid service name, want dot-separated non-empty parts such as billing.Invoice"}
+	}
+	service.name = name
+	service.logger = logger
+	skipped := service.registerMethods(logger)
+	if len(service.method) == 0 {
+		return nil, &RegisterError{Service: name, Reason: "type " + service.typ.String() + " has no exported methods of suitable type", Skipped: skipped}
+	}
+	for _, m := range skipped {
+		logger.Warn("rpc server: skip method", "service", name, "method", m.Name, "reason", m.Reason)
+	}
+	service.skipped = skipped
+	return service, nil
+}
+
+func validServiceName(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		if part == "" || strings.ContainsAny(part, " \t\n/") {
+			return false
+		}
 	}
-	service.registerMethods()
-	return service
+	return true
 }
 
-func (service *Service) registerMethods() {
+// registerMethods collects the eligible methods and returns the others.
+func (service *Service) registerMethods(logger *slog.Logger) []SkippedMethod {
 	service.method = make(map[string]*MethodEntry)
+	var skipped []SkippedMethod
 	for i := 0; i < service.typ.NumMethod(); i++ {
 		method := service.typ.Method(i)
-		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
-		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		// the bound method value takes the same arguments minus the receiver
+		m, reason := newMethodEntry(service.serviceObj.Method(i))
+		if reason != "" {
+			skipped = append(skipped, SkippedMethod{Name: method.Name, Reason: reason})
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
-			continue
+		service.method[method.Name] = m
+		logger.Info("rpc server: register", "service", service.name, "method", method.Name)
+	}
+	return skipped
+}
+
+// newMethodEntry checks that fn can be called over RPC, returning why not
+// otherwise. Eligible functions look like one of
+//
+//	func(args Args, reply *Reply) error
+//	func(ctx context.Context, args Args, reply *Reply) error
+//	func(args Args) (Reply, error)
+//	func(ctx context.Context, args Args) (Reply, error)
+func newMethodEntry(fn reflect.Value) (*MethodEntry, string) {
+	fnType := fn.Type()
+	m := &MethodEntry{fn: fn}
+	switch {
+	case fnType.NumOut() != 1 && fnType.NumOut() != 2:
+		return nil, "must return error or (reply, error)"
+	case fnType.Out(fnType.NumOut()-1) != errorType:
+		return nil, "last result must be an error"
+	}
+	m.returnsReply = fnType.NumOut() == 2
+	// the arguments besides the context: args, and reply unless returned
+	want := 2
+	if m.returnsReply {
+		want = 1
+	}
+	takesContext := fnType.NumIn() > 0 && fnType.In(0) == contextType
+	if m.returnsReply && (fnType.NumIn() == 2 && !takesContext || fnType.NumIn() == 3 && takesContext) {
+		return nil, "returns (reply, error) and takes a reply argument, want one error result with the reply argument"
+	}
+	switch fnType.NumIn() {
+	case want:
+	case want + 1:
+		if fnType.In(0) != contextType {
+			return nil, fmt.Sprintf("first of %d arguments must be a context.Context", want+1)
 		}
-		service.method[method.Name] = &MethodEntry{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		m.hasContext = true
+	default:
+		if m.returnsReply {
+			return nil, fmt.Sprintf("takes %d arguments, want args optionally after a context.Context when returning (reply, error)", fnType.NumIn())
 		}
-		log.Printf("rpc server: register %s.%s\n", service.name, method.Name)
+		return nil, fmt.Sprintf("takes %d arguments, want args and reply, optionally after a context.Context", fnType.NumIn())
+	}
+	first := 0
+	if m.hasContext {
+		first = 1
+	}
+	m.ArgType = fnType.In(first)
+	if m.returnsReply {
+		m.ReplyType = reflect.PointerTo(fnType.Out(0))
+	} else {
+		m.ReplyType = fnType.In(first + 1)
 	}
+	switch {
+	case !isExportedOrBuiltinType(m.ArgType):
+		return nil, "argument type " + m.ArgType.String() + " is not exported"
+	case m.ReplyType.Kind() != reflect.Ptr:
+		return nil, "reply type " + m.ReplyType.String() + " is not a pointer"
+	case !isExportedOrBuiltinType(m.ReplyType):
+		return nil, "reply type " + m.ReplyType.String() + " is not exported"
+	}
+	if err := checkValidateTags(m.ArgType, make(map[reflect.Type]bool)); err != nil {
+		return nil, "invalid validate tag in " + err.Error()
+	}
+	return m, ""
 }
 
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
 func (service *Service) Call(m *MethodEntry, argv, replyv reflect.Value) error {
+	return service.CallContext(context.Background(), m, argv, replyv)
+}
+
+// CallContext invokes the method, passing ctx along if it takes a context.
+// A panicking method no longer takes the worker down with it: the panic is
+// recovered and logged with its stack, counted in MethodStats.Panics, and
+// the call fails with an Internal error.
+func (service *Service) CallContext(ctx context.Context, m *MethodEntry, argv, replyv reflect.Value) (err error) {
 	atomic.AddUint64(&m.numCalls, 1)
-	function := m.method.Func
-	returnValues := function.Call([]reflect.Value{service.serviceObj, argv, replyv})
-	if errInter := returnValues[0].Interface(); errInter != nil {
+	atomic.AddInt64(&m.inFlight, 1)
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			atomic.AddUint64(&m.panics, 1)
+			service.logger.Error("rpc server: method panicked", "service", service.key(), "panic", p, "stack", string(debug.Stack()))
+			err = status.New(status.Internal, "method panicked")
+		}
+		m.latency.Observe(time.Since(start))
+		atomic.AddInt64(&m.inFlight, -1)
+		if err != nil {
+			m.recordError(status.FromContextError(err).Code)
+		} else {
+			atomic.AddUint64(&m.successes, 1)
+		}
+	}()
+	in := make([]reflect.Value, 0, 3)
+	if m.hasContext {
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
+	in = append(in, argv)
+	if !m.returnsReply {
+		in = append(in, replyv)
+	}
+	returnValues := m.fn.Call(in)
+	if errInter := returnValues[len(returnValues)-1].Interface(); errInter != nil {
 		return errInter.(error)
 	}
+	if m.returnsReply {
+		replyv.Elem().Set(returnValues[0])
+	}
 	return nil
 }
 
@@ -100,8 +284,15 @@ func isExportedOrBuiltinType(typ reflect.Type) bool {
 	return ast.IsExported(typ.Name()) || typ.PkgPath() == ""
 }
 
+// Registry is safe for concurrent use: services may be registered,
+// unregistered and replaced while calls are being served.
 type Registry struct {
-	serviceMap map[string]*Service
+	mu            sync.RWMutex
+	serviceMap    map[string]*Service // keyed by Service.key
+	defaults      map[string]string   // set with SetDefaultVersion
+	firstVersions map[string]string   // the version of each service registered first
+	seq           uint64              // of the last service registered
+	logger        *slog.Logger
 }
 
 func NewRegistry() *Registry {
@@ -112,28 +303,196 @@ func NewRegistry() *Registry {
 
 var DefaultRegistry = NewRegistry()
 
+// SetLogger replaces the logger registrations are reported to, slog.Default() by default.
+func (registry *Registry) SetLogger(logger *slog.Logger) {
+	registry.logger = logger
+}
+
+func (registry *Registry) getLogger() *slog.Logger {
+	if registry.logger == nil {
+		return slog.Default()
+	}
+	return registry.logger
+}
+
 // 注册服务
-func (registry *Registry) Register(serviceObj interface{}) error {
+//
+// Register publishes the methods of serviceObj under its type name. It fails
+// with a *RegisterError when the type isn't exported or has no eligible
+// method, or when opts don't fit its methods.
+func (registry *Registry) Register(serviceObj interface{}, opts ...Option) error {
+	return registry.RegisterName("", serviceObj, opts...)
+}
+
+// RegisterName is Register under name instead of the type name, so one type
+// can be registered several times or under a namespace, e.g. "billing.Invoice".
+// A name such as "Math@v2" registers a version, as WithVersion does.
+func (registry *Registry) RegisterName(name string, serviceObj interface{}, opts ...Option) error {
+	service, err := registry.newService(serviceObj, name, opts)
+	if err != nil {
+		return err
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.serviceMap == nil {
+		registry.serviceMap = make(map[string]*Service)
+	}
+	if _, exists := registry.serviceMap[service.key()]; exists {
+		return errors.New("registry: service already defined: " + service.key())
+	}
+	registry.serviceMap[service.key()] = service
+	registry.addedLocked(service)
+	return nil
+}
+
+// newService inspects serviceObj and applies the registration options.
+func (registry *Registry) newService(serviceObj interface{}, name string, opts []Option) (*Service, error) {
+	service, err := newService(serviceObj, name, registry.getLogger())
+	if err != nil {
+		return nil, err
+	}
+	o := newRegisterOptions(opts)
+	if err := o.setVersion(service); err != nil {
+		return nil, err
+	}
+	if err := o.apply(service); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// RegisterFunc publishes fn as serviceMethod, e.g. "Math.Mul". fn takes the
+// same shapes as methods do, see newMethodEntry; RegisterTyped checks them at
+// compile time. Functions registered under the same service name make up one
+// service, which can't also be a registered type. Options given with
+// WithOptions apply to fn alone.
+func (registry *Registry) RegisterFunc(serviceMethod string, fn interface{}, opts ...Option) error {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 || !validServiceName(serviceMethod) {
+		return &RegisterError{Service: serviceMethod, Reason: "invalid name, want Service.Method"}
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return &RegisterError{Service: serviceMethod, Reason: fmt.Sprintf("%T is not a function", fn)}
+	}
+	m, reason := newMethodEntry(fv)
+	if reason != "" {
+		return &RegisterError{Service: serviceMethod, Reason: reason}
+	}
+	// services are never modified once found, so add to a copy
+	service := &Service{name: serviceName, method: map[string]*MethodEntry{methodName: m}, logger: registry.getLogger()}
+	o := newRegisterOptions(opts)
+	if err := o.setVersion(service); err != nil {
+		return err
+	}
+	if err := o.apply(service); err != nil {
+		return err
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
 	if registry.serviceMap == nil {
 		registry.serviceMap = make(map[string]*Service)
 	}
+	if existing, ok := registry.serviceMap[service.key()]; ok {
+		if existing.serviceObj.IsValid() {
+			return errors.New("registry: service already defined: " + service.key())
+		}
+		if _, ok := existing.method[methodName]; ok {
+			return errors.New("registry: method already defined: " + service.key() + "." + methodName)
+		}
+		for name, other := range existing.method {
+			service.method[name] = other
+		}
+		service.seq = existing.seq
+	}
+	registry.serviceMap[service.key()] = service
+	registry.addedLocked(service)
+	registry.getLogger().Info("rpc server: register", "service", service.key(), "method", methodName)
+	return nil
+}
+
+// RegisterFunc registers fn as serviceMethod with DefaultRegistry.
+func RegisterFunc(serviceMethod string, fn interface{}, opts ...Option) error {
+	return DefaultRegistry.RegisterFunc(serviceMethod, fn, opts...)
+}
 
-	service := newService(serviceObj)
-	if _, exists := registry.serviceMap[service.name]; exists {
-		return errors.New("registry: service already defined: " + service.name)
+// RegisterTyped is RegisterFunc for a function whose signature the compiler
+// checks, e.g.
+//
+//	registry.RegisterTyped(r, "Math.Mul", func(ctx context.Context, args Args) (int, error) {
+//		return args.A * args.B, nil
+//	})
+func RegisterTyped[Args, Reply any](registry *Registry, serviceMethod string, fn func(ctx context.Context, args Args) (Reply, error), opts ...Option) error {
+	return registry.RegisterFunc(serviceMethod, fn, opts...)
+}
+
+// Unregister removes the service called name, "Math@v1" for a version.
+// Calls already running finish, later ones fail as if it was never
+// registered, or go to the next default version.
+func (registry *Registry) Unregister(name string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	service, exists := registry.serviceMap[name]
+	if !exists {
+		return errors.New("registry: service not defined: " + name)
 	}
-	registry.serviceMap[service.name] = service
+	delete(registry.serviceMap, name)
+	registry.removedLocked(service)
+	registry.getLogger().Info("rpc server: unregister", "service", name)
 	return nil
 }
 
+// Replace swaps serviceObj in for the registered service of the same name.
+// Calls already running finish on the old implementation and every call
+// found afterwards goes to the new one, whose statistics start from zero.
+// The options of the old service are dropped for opts.
+func (registry *Registry) Replace(serviceObj interface{}, opts ...Option) error {
+	return registry.ReplaceName("", serviceObj, opts...)
+}
+
+// ReplaceName is Replace for a service registered with RegisterName.
+func (registry *Registry) ReplaceName(name string, serviceObj interface{}, opts ...Option) error {
+	service, err := registry.newService(serviceObj, name, opts)
+	if err != nil {
+		return err
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	existing, exists := registry.serviceMap[service.key()]
+	if !exists {
+		return errors.New("registry: service not defined: " + service.key())
+	}
+	service.seq = existing.seq
+	registry.serviceMap[service.key()] = service
+	return nil
+}
+
+// FindService looks up "Service.Method", or "Service@version.Method", in
+// the default version of the service when none is named.
 func (registry *Registry) FindService(serviceMethod string) (*Service, *MethodEntry, error) {
+	return registry.FindVersion(serviceMethod, "")
+}
+
+// FindVersion is FindService for version of the service, e.g. from the
+// caller's metadata; a version in serviceMethod takes precedence.
+func (registry *Registry) FindVersion(serviceMethod, version string) (*Service, *MethodEntry, error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
 		return nil, nil, errors.New("registry: service/method request ill-formed: " + serviceMethod)
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
-	storedService, ok := registry.serviceMap[serviceName]
+	serviceName, named := splitVersion(serviceName)
+	if named != "" {
+		version = named
+	}
+	registry.mu.RLock()
+	storedService, ok := registry.lookupLocked(serviceName, version)
+	registry.mu.RUnlock()
 	if !ok {
+		if version != "" {
+			return nil, nil, errors.New("registry: can't find version " + version + " of service " + serviceName)
+		}
 		return nil, nil, errors.New("registry: can't find service " + serviceName)
 	}
 	mtype, ok := storedService.method[methodName]
@@ -142,3 +501,90 @@ func (registry *Registry) FindService(serviceMethod string) (*Service, *MethodEn
 	}
 	return storedService, mtype, nil
 }
+
+type MethodInfo struct {
+	Name        string         `json:"name"`
+	ArgSchema   *Schema        `json:"args"`
+	ReplySchema *Schema        `json:"reply"`
+	NumCalls    uint64         `json:"numCalls"`
+	Options     *MethodOptions `json:"options,omitempty"` // nil when none are set
+}
+
+type ServiceInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// Default is set on the version serving callers that name none.
+	Default bool `json:"default,omitempty"`
+	// NumCalls sums the calls of the methods, telling whether callers still
+	// use this version.
+	NumCalls uint64       `json:"numCalls"`
+	Methods  []MethodInfo `json:"methods"`
+	// Skipped are the exported methods left out as they can't be called
+	// over RPC.
+	Skipped []SkippedMethod `json:"skipped,omitempty"`
+}
+
+// Methods returns every registered method keyed by "Service.Method", or
+// "Service@version.Method" for versions.
+func (registry *Registry) Methods() map[string]*MethodEntry {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	methods := make(map[string]*MethodEntry)
+	for _, service := range registry.serviceMap {
+		for name, m := range service.method {
+			methods[service.key()+"."+name] = m
+		}
+	}
+	return methods
+}
+
+// Services describes every registered service and method, sorted by name
+// and version.
+func (registry *Registry) Services() []ServiceInfo {
+	registry.mu.RLock()
+	services := make([]*Service, 0, len(registry.serviceMap))
+	versions := make(map[string]int)
+	defaults := make(map[*Service]bool)
+	for _, service := range registry.serviceMap {
+		services = append(services, service)
+		versions[service.name]++
+		if def, ok := registry.lookupLocked(service.name, ""); ok && def == service {
+			defaults[service] = true
+		}
+	}
+	registry.mu.RUnlock()
+	infos := make([]ServiceInfo, 0, len(services))
+	for _, service := range services {
+		info := service.describe()
+		// a service without versions is its own default, no need to say so
+		info.Default = defaults[service] && (service.version != "" || versions[service.name] > 1)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].Version < infos[j].Version
+	})
+	return infos
+}
+
+func (service *Service) describe() ServiceInfo {
+	info := ServiceInfo{Name: service.name, Version: service.version, Methods: make([]MethodInfo, 0, len(service.method)), Skipped: service.skipped}
+	for name, m := range service.method {
+		methodInfo := MethodInfo{
+			Name:        name,
+			ArgSchema:   SchemaOf(m.ArgType),
+			ReplySchema: SchemaOf(m.ReplyType.Elem()),
+			NumCalls:    m.NumCalls(),
+		}
+		if !m.Options.isZero() {
+			opts := m.Options
+			methodInfo.Options = &opts
+		}
+		info.Methods = append(info.Methods, methodInfo)
+		info.NumCalls += methodInfo.NumCalls
+	}
+	sort.Slice(info.Methods, func(i, j int) bool { return info.Methods[i].Name < info.Methods[j].Name })
+	return info
+}
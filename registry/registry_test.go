@@ -1,9 +1,19 @@
 package registry
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"reflect"
+	"rpcsimple/status"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -29,7 +39,8 @@ func _assert(condition bool, msg string, v ...interface{}) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, err := newService(&foo, "", slog.Default())
+	_assert(err == nil, "failed to create Foo: %v", err)
 	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong Method, Sum shouldn't nil")
@@ -37,12 +48,432 @@ func TestNewService(t *testing.T) {
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, err := newService(&foo, "", slog.Default())
+	_assert(err == nil, "failed to create Foo: %v", err)
 	mType := s.method["Sum"]
 
 	argv := mType.NewArgv()
 	replyv := mType.NewReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
-	err := s.Call(mType, argv, replyv)
+	err = s.Call(mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+type unexported int
+
+func (u unexported) Sum(args Args, reply *int) error { return nil }
+
+type Broken int
+
+func (b Broken) NoReply(args Args) error                           { return nil }
+func (b Broken) ByValue(args Args, reply int) error                { return nil }
+func (b Broken) TwoResults(args Args, reply *int) (int, error)     { return 0, nil }
+func (b Broken) NoContext(ctx string, args Args, reply *int) error { return nil }
+
+type Partly int
+
+func (p Partly) Sum(args Args, reply *int) error { return nil }
+func (p Partly) NoReply(args Args) error         { return nil }
+
+func TestRegistry_RegisterErrors(t *testing.T) {
+	r := NewRegistry()
+	var u unexported
+	err := r.Register(&u)
+	_assert(err != nil && strings.Contains(err.Error(), "not exported"), "unexported type should be rejected, got %v", err)
+	_assert(r.RegisterName("Adder", &u) == nil, "RegisterName should accept an unexported type")
+
+	var nilFoo *Foo
+	var registerErr *RegisterError
+	_assert(errors.As(r.Register(nilFoo), &registerErr) && registerErr.Service == "Foo", "a nil *Foo should be rejected, got %v", registerErr)
+
+	var b Broken
+	_assert(errors.As(r.Register(&b), &registerErr), "Broken should be rejected")
+	reasons := make(map[string]string)
+	for _, m := range registerErr.Skipped {
+		reasons[m.Name] = m.Reason
+	}
+	_assert(len(reasons) == 4, "expect 4 skipped methods, but got %v", registerErr.Skipped)
+	_assert(strings.Contains(reasons["ByValue"], "not a pointer"), "wrong reason for ByValue: %s", reasons["ByValue"])
+	_assert(strings.Contains(reasons["TwoResults"], "one error") && strings.Contains(reasons["TwoResults"], "reply argument"), "wrong reason for TwoResults: %s", reasons["TwoResults"])
+	_assert(strings.Contains(reasons["NoContext"], "context.Context"), "wrong reason for NoContext: %s", reasons["NoContext"])
+
+	var foo Foo
+	_assert(r.RegisterName("billing.Invoice", &foo) == nil, "failed to register billing.Invoice")
+	_assert(r.RegisterName("billing.Refund", &foo) == nil, "the same type should register under another name")
+	_assert(r.RegisterName("billing.", &foo) != nil, "empty name parts should be rejected")
+	service, m, err := r.FindService("billing.Invoice.Sum")
+	_assert(err == nil && service.Name() == "billing.Invoice" && m != nil, "can't find billing.Invoice.Sum: %v", err)
+
+	var buf bytes.Buffer
+	r = NewRegistry()
+	r.SetLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	var p Partly
+	_assert(r.Register(&p) == nil, "Partly should register with its eligible method")
+	_assert(strings.Contains(buf.String(), "skip method") && strings.Contains(buf.String(), "NoReply"), "the skipped method should be logged, got %s", buf.String())
+	info := r.Services()[0]
+	_assert(len(info.Skipped) == 1 && info.Skipped[0].Name == "NoReply", "the skipped method should be listed, got %+v", info.Skipped)
+}
+
+type Calc struct{}
+
+func (c *Calc) Double(n int) (int, error) { return 2 * n, nil }
+
+func (c *Calc) Half(ctx context.Context, n *int) (float64, error) {
+	if ctx == nil {
+		return 0, errors.New("no context")
+	}
+	return float64(*n) / 2, nil
+}
+
+func call(r *Registry, serviceMethod string, args interface{}) (interface{}, error) {
+	service, m, err := r.FindService(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	argv := m.NewArgv()
+	if argv.Kind() == reflect.Ptr {
+		argv.Elem().Set(reflect.ValueOf(args))
+	} else {
+		argv.Set(reflect.ValueOf(args))
+	}
+	replyv := m.NewReplyv()
+	err = service.CallContext(context.Background(), m, argv, replyv)
+	return replyv.Elem().Interface(), err
+}
+
+func TestRegistry_RegisterFunc(t *testing.T) {
+	r := NewRegistry()
+	_assert(r.Register(&Calc{}) == nil, "failed to register Calc")
+	reply, err := call(r, "Calc.Double", 21)
+	_assert(err == nil && reply == 42, "Calc.Double returned %v: %v", reply, err)
+	reply, err = call(r, "Calc.Half", 3)
+	_assert(err == nil && reply == 1.5, "Calc.Half returned %v: %v", reply, err)
+
+	_assert(r.RegisterFunc("Math.Mul", func(ctx context.Context, args Args) (int, error) {
+		return args.Num1 * args.Num2, nil
+	}) == nil, "failed to register Math.Mul")
+	_assert(r.RegisterFunc("Math.Sum", Foo(0).Sum) == nil, "failed to register Math.Sum")
+	_assert(RegisterTyped(r, "Math.Neg", func(ctx context.Context, n int) (int, error) { return -n, nil }) == nil,
+		"failed to register Math.Neg")
+	reply, err = call(r, "Math.Mul", Args{Num1: 6, Num2: 7})
+	_assert(err == nil && reply == 42, "Math.Mul returned %v: %v", reply, err)
+	reply, err = call(r, "Math.Sum", Args{Num1: 6, Num2: 7})
+	_assert(err == nil && reply == 13, "Math.Sum returned %v: %v", reply, err)
+	reply, err = call(r, "Math.Neg", 5)
+	_assert(err == nil && reply == -5, "Math.Neg returned %v: %v", reply, err)
+	_assert(len(r.Services()) == 2, "funcs of one service should be grouped, got %v", r.Services())
+
+	_assert(r.RegisterFunc("Math.Mul", Foo(0).Sum) != nil, "Math.Mul is already defined")
+	_assert(r.RegisterFunc("Calc.Triple", Foo(0).Sum) != nil, "Calc is a registered type")
+	_assert(r.RegisterFunc("Math.Bad", func(a, b, c int) error { return nil }) != nil, "bad signature should be rejected")
+	_assert(r.RegisterFunc("Math.NotFunc", 42) != nil, "non functions should be rejected")
+}
+
+func TestRegistry_Options(t *testing.T) {
+	r := NewRegistry()
+	err := r.Register(&Calc{},
+		WithOptions(MethodOptions{MaxTimeout: time.Second, Scopes: []string{"calc"}}),
+		WithMethodOptions("Half", MethodOptions{DefaultTimeout: 100 * time.Millisecond, ReadOnly: true, RateLimit: 2}))
+	_assert(err == nil, "failed to register Calc: %v", err)
+	_, half, _ := r.FindService("Calc.Half")
+	_, double, _ := r.FindService("Calc.Double")
+	_assert(half.Options.MaxTimeout == time.Second && half.Options.DefaultTimeout == 100*time.Millisecond,
+		"method options should merge over service options, got %+v", half.Options)
+	_assert(half.Options.SafeToRepeat() && !double.Options.SafeToRepeat(), "only Half is read-only")
+	_assert(len(double.Options.Scopes) == 1 && double.Options.DefaultTimeout == 0, "Double should get the service options, got %+v", double.Options)
+	_assert(half.Allow() && half.Allow() && !half.Allow(), "the burst should default to the rate")
+	_assert(double.Allow(), "Double has no rate limit")
+
+	info := r.Services()[0].Methods
+	_assert(info[1].Name == "Half" && info[1].Options.ReadOnly, "options should be described, got %+v", info)
+	body, _ := json.Marshal(info[1].Options)
+	_assert(strings.Contains(string(body), `"defaultTimeout":"100ms"`), "durations should be readable, got %s", body)
+
+	err = NewRegistry().Register(&Calc{}, WithMethodOptions("Triple", MethodOptions{ReadOnly: true}))
+	_assert(err != nil && strings.Contains(err.Error(), "unknown method Triple"), "options for unknown methods should fail, got %v", err)
+	err = NewRegistry().Register(&Calc{}, WithOptions(MethodOptions{DefaultTimeout: time.Minute, MaxTimeout: time.Second}))
+	_assert(err != nil, "a default timeout above the max should fail")
+	err = NewRegistry().Register(&Calc{}, WithOptions(MethodOptions{CacheTTL: time.Second}))
+	_assert(err != nil && strings.Contains(err.Error(), "not read-only"), "caching replies of methods that aren't read-only should fail, got %v", err)
+	err = r.RegisterFunc("Math.Mul", func(ctx context.Context, args Args) (int, error) {
+		return args.Num1 * args.Num2, nil
+	}, WithOptions(MethodOptions{Deprecated: "use Calc.Mul"}))
+	_assert(err == nil, "failed to register Math.Mul: %v", err)
+	_, mul, _ := r.FindService("Math.Mul")
+	_assert(mul.Options.Deprecated == "use Calc.Mul", "RegisterFunc should take options")
+}
+
+type SumV2 struct{}
+
+type Terms struct{ Terms []int }
+
+func (s *SumV2) Sum(args Terms, reply *int) error {
+	for _, term := range args.Terms {
+		*reply += term
+	}
+	return nil
+}
+
+func TestRegistry_Versions(t *testing.T) {
+	r := NewRegistry()
+	_assert(r.RegisterName("Math@v1", Foo(0)) == nil, "failed to register Math@v1")
+	_assert(r.RegisterName("Math", &SumV2{}, WithVersion("v2")) == nil, "failed to register Math v2")
+	_assert(r.RegisterName("Math@v2", &SumV2{}) != nil, "Math@v2 is already defined")
+	_assert(r.RegisterName("Math@v3", &SumV2{}, WithVersion("v4")) != nil, "conflicting versions should fail")
+	_assert(r.RegisterName("Math@", &SumV2{}) != nil, "empty versions should fail")
+
+	version, ok := r.DefaultVersion("Math")
+	_assert(ok && version == "v1", "the first version should be the default, got %q", version)
+	reply, err := call(r, "Math.Sum", Args{Num1: 1, Num2: 2})
+	_assert(err == nil && reply == 3, "Math.Sum should reach v1, got %v: %v", reply, err)
+	reply, err = call(r, "Math@v2.Sum", Terms{Terms: []int{1, 2, 3}})
+	_assert(err == nil && reply == 6, "Math@v2.Sum returned %v: %v", reply, err)
+	_, m, err := r.FindVersion("Math.Sum", "v2")
+	_assert(err == nil && m.ArgType == reflect.TypeOf(Terms{}), "FindVersion should find v2: %v", err)
+	_, _, err = r.FindVersion("Math.Sum", "v3")
+	_assert(err != nil, "unknown versions should not be found")
+
+	_assert(r.SetDefaultVersion("Math", "v3") != nil, "the default version must be registered")
+	_assert(r.SetDefaultVersion("Math", "v2") == nil, "failed to set the default version")
+	_, m, _ = r.FindService("Math.Sum")
+	_assert(m.ArgType == reflect.TypeOf(Terms{}), "Math.Sum should reach v2")
+
+	infos := r.Services()
+	_assert(len(infos) == 2 && infos[0].Version == "v1" && !infos[0].Default && infos[1].Default,
+		"versions should be described, got %+v", infos)
+	_assert(infos[1].NumCalls == 1 && infos[0].NumCalls == 1, "calls should be counted per version, got %+v", infos)
+	_, ok = r.Methods()["Math@v2.Sum"]
+	_assert(ok, "Methods should key versions")
+
+	_assert(r.Unregister("Math@v2") == nil, "failed to unregister Math@v2")
+	version, _ = r.DefaultVersion("Math")
+	_assert(version == "v1", "the default should fall back to v1, got %q", version)
+
+	// the fallback follows registration order, not the version strings
+	_assert(r.RegisterName("Math", &SumV2{}, WithVersion("v9")) == nil, "failed to register Math v9")
+	_assert(r.RegisterName("Math", &SumV2{}, WithVersion("v10")) == nil, "failed to register Math v10")
+	_assert(r.Unregister("Math@v1") == nil, "failed to unregister Math@v1")
+	version, _ = r.DefaultVersion("Math")
+	_assert(version == "v9", "the default should fall back to v9, got %q", version)
+}
+
+type Address struct {
+	City string `json:"city" validate:"required"`
+	Zip  string `json:"zip" validate:"omitempty,len=5"`
+}
+
+type Order struct {
+	Name     string             `json:"name" validate:"required,max=5"`
+	Quantity int                `json:"quantity" validate:"min=1,max=100"`
+	Size     string             `json:"size" validate:"oneof=S M L"`
+	Code     *uint              `json:"code,omitempty" validate:"oneof=1000000 7"`
+	Items    []string           `json:"items" validate:"min=1"`
+	Ship     Address            `json:"ship"`
+	Extra    []*Address         `json:"extra"`
+	ByName   map[string]Address `json:"byName"`
+}
+
+type BadTags struct {
+	N int `validate:"len=2"`
+}
+
+func TestValidate(t *testing.T) {
+	code := uint(1000000)
+	valid := Order{Name: "tea", Quantity: 2, Size: "M", Code: &code, Items: []string{"cup"}, Ship: Address{City: "Oslo"}}
+	_assert(len(Validate(&valid)) == 0, "valid order rejected: %v", Validate(&valid))
+
+	wrongCode := uint(8)
+	order := Order{
+		Name:   "teapots",
+		Size:   "XL",
+		Code:   &wrongCode,
+		Ship:   Address{Zip: "123"},
+		Extra:  []*Address{{City: "Rome"}, nil, {}},
+		ByName: map[string]Address{"home": {}},
+	}
+	got := make(map[string]string)
+	for _, v := range Validate(order) {
+		got[v.Field] = v.Description
+	}
+	want := map[string]string{
+		"name":              "must have at most 5 characters",
+		"quantity":          "must be at least 1",
+		"size":              "must be one of S, M, L",
+		"code":              "must be one of 1000000, 7",
+		"items":             "must have at least 1 items",
+		"ship.city":         "is required",
+		"ship.zip":          "must have exactly 5 characters",
+		"extra[2].city":     "is required",
+		"byName[home].city": "is required",
+	}
+	_assert(reflect.DeepEqual(got, want), "wrong violations %v", got)
+
+	err := NewRegistry().RegisterFunc("Bad.Call", func(args BadTags, reply *int) error { return nil })
+	_assert(err != nil && strings.Contains(err.Error(), "len doesn't apply to int"), "bad tags should fail registration, got %v", err)
+}
+
+type Flaky struct{}
+
+func (f *Flaky) Do(n int, reply *int) error {
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		return status.New(status.NotFound, "no such thing")
+	case 2:
+		return errors.New("plain error")
+	}
+	panic("boom")
+}
+
+func TestMethodEntry_Stats(t *testing.T) {
+	r := NewRegistry()
+	r.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	_assert(r.Register(&Flaky{}) == nil, "failed to register Flaky")
+	for _, n := range []int{0, 0, 1, 2, 3} {
+		call(r, "Flaky.Do", n)
+	}
+	_, err := call(r, "Flaky.Do", 3)
+	_assert(status.CodeOf(err) == status.Internal, "panics should fail as Internal, got %v", err)
+	_, m, _ := r.FindService("Flaky.Do")
+	m.RecordTransfer(10, 20)
+	m.RecordTimeout()
+
+	stats := m.Stats()
+	_assert(stats.Calls == 6 && stats.Successes == 2 && stats.Errors == 4 && stats.Panics == 2 && stats.InFlight == 0,
+		"wrong counters %+v", stats)
+	_assert(reflect.DeepEqual(stats.ErrorsByCode, map[status.Code]uint64{status.NotFound: 1, status.Unknown: 1, status.Internal: 2}),
+		"wrong errors by code %v", stats.ErrorsByCode)
+	_assert(stats.BytesIn == 10 && stats.BytesOut == 20 && stats.Timeouts == 1, "wrong transfer counters %+v", stats)
+	_assert(stats.Latency.Count == 6 && stats.Latency.P99 > 0, "latency should be observed, got %+v", stats.Latency)
+
+	_assert(reflect.DeepEqual(m.ResetStats(), stats), "ResetStats should return the stats so far")
+	stats = r.Stats()["Flaky.Do"]
+	_assert(stats.Calls == 0 && stats.ErrorsByCode == nil && stats.Latency.Count == 0, "stats should be reset, got %+v", stats)
+}
+
+type Node struct {
+	Value    int               `json:"value"`
+	Label    string            `json:"label,omitempty"`
+	Secret   string            `json:"-"`
+	Children []*Node           `json:"children"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := SchemaOf(reflect.TypeOf(Node{}))
+	_assert(s.Ref == "#/$defs/Node", "wrong root ref %q", s.Ref)
+	node := s.Defs["Node"]
+	_assert(node != nil && node.Type == "object", "Node should be defined as an object")
+	_assert(len(node.Properties) == 4, "expect 4 properties, but got %d", len(node.Properties))
+	_assert(node.Properties["value"].Type == "integer", "value should be an integer")
+	_assert(node.Properties["children"].Items.Ref == "#/$defs/Node", "children should refer back to Node")
+	_assert(node.Properties["attrs"].AdditionalProperties.Type == "string", "attrs should be a map of strings")
+	_assert(reflect.DeepEqual(node.Required, []string{"value", "children"}), "wrong required fields %v", node.Required)
+}
+
+func TestMissingFields(t *testing.T) {
+	typ := reflect.TypeOf(Node{})
+	missing := MissingFields(typ, json.RawMessage(`{"VALUE":1,"children":[{"value":2,"children":null},{"children":[]}]}`))
+	_assert(len(missing) == 1 && missing[0].Field == "children[1].value", "wrong missing fields %v", missing)
+	missing = MissingFields(typ, nil)
+	_assert(len(missing) == 2 && missing[0].Field == "value" && missing[1].Field == "children", "absent args miss every required field, got %v", missing)
+}
+
+func TestRegistry_Services(t *testing.T) {
+	var foo Foo
+	r := NewRegistry()
+	_assert(r.Register(&foo) == nil, "failed to register Foo")
+	infos := r.Services()
+	_assert(len(infos) == 1 && infos[0].Name == "Foo", "wrong services %v", infos)
+	_assert(len(infos[0].Methods) == 1 && infos[0].Methods[0].Name == "Sum", "wrong methods %v", infos[0].Methods)
+	_assert(infos[0].Methods[0].ReplySchema.Type == "integer", "reply of Sum should be an integer")
+}
+
+type Greeter struct {
+	greeting string
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func (g *Greeter) Greet(name string, reply *string) error {
+	if g.release != nil {
+		g.started <- struct{}{}
+		<-g.release
+	}
+	*reply = g.greeting + ", " + name
+	return nil
+}
+
+func greet(r *Registry) (string, error) {
+	service, m, err := r.FindService("Greeter.Greet")
+	if err != nil {
+		return "", err
+	}
+	replyv := m.NewReplyv()
+	err = service.Call(m, reflect.ValueOf("Ann"), replyv)
+	return *replyv.Interface().(*string), err
+}
+
+func TestRegistry_Replace(t *testing.T) {
+	r := NewRegistry()
+	old := &Greeter{greeting: "Hello", started: make(chan struct{}), release: make(chan struct{})}
+	_assert(r.Replace(old) != nil, "Replace should fail for a service never registered")
+	_assert(r.Register(old) == nil, "failed to register Greeter")
+
+	inflight := make(chan string)
+	go func() {
+		reply, _ := greet(r)
+		inflight <- reply
+	}()
+	<-old.started
+	_assert(r.Replace(&Greeter{greeting: "Hi"}) == nil, "failed to replace Greeter")
+	reply, err := greet(r)
+	_assert(err == nil && reply == "Hi, Ann", "new calls should reach the new implementation, but got %q", reply)
+	close(old.release)
+	_assert(<-inflight == "Hello, Ann", "the in-flight call should finish on the old implementation")
+
+	_assert(r.Unregister("Greeter") == nil, "failed to unregister Greeter")
+	_, err = greet(r)
+	_assert(err != nil, "Greeter should be gone")
+	_assert(r.Unregister("Greeter") != nil, "Unregister should fail for an unknown service")
+}
+
+func TestRegistry_Concurrent(t *testing.T) {
+	r := NewRegistry()
+	r.Register(&Greeter{greeting: "Hello"})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Replace(&Greeter{greeting: "Hi"})
+				var foo Foo
+				r.Register(&foo)
+				r.Unregister("Foo")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				greet(r)
+				r.Services()
+				r.Methods()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type Login struct {
+	User     string `json:"user"`
+	Password string `rpc:"sensitive"`
+	Token    string `json:"token"`
+}
+
+func TestRedact(t *testing.T) {
+	got := Redact(&Login{User: "bob", Password: "hunter2", Token: "t"}, "token")
+	want := map[string]interface{}{"user": "bob", "Password": Redacted, "token": Redacted}
+	_assert(reflect.DeepEqual(got, want), "wrong redaction %v", got)
+}
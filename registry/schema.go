@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"encoding/json"
+	"reflect"
+	"rpcsimple/status"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of JSON Schema needed to describe the argument and
+// reply types of registered methods.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	bytesType      = reflect.TypeOf([]byte{})
+)
+
+// SchemaOf derives a JSON Schema for typ following the encoding/json rules:
+// json tags rename or hide fields, omitempty fields are optional and embedded
+// structs are flattened. Named struct types are emitted once under $defs and
+// referenced, which keeps recursive types finite.
+func SchemaOf(typ reflect.Type) *Schema {
+	b := &schemaBuilder{defs: make(map[string]*Schema), names: make(map[reflect.Type]string)}
+	root := b.schema(typ)
+	if len(b.defs) > 0 {
+		root.Defs = b.defs
+	}
+	return root
+}
+
+type schemaBuilder struct {
+	defs  map[string]*Schema
+	names map[reflect.Type]string
+}
+
+func (b *schemaBuilder) schema(typ reflect.Type) *Schema {
+	if typ == nil {
+		return &Schema{}
+	}
+	switch typ {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &Schema{}
+	case bytesType:
+		return &Schema{Type: "string", Format: "byte"}
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		s := b.schema(typ.Elem())
+		if s.Ref != "" {
+			return &Schema{Ref: s.Ref, Nullable: true}
+		}
+		s.Nullable = true
+		return s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &Schema{Type: "integer", Format: typ.Kind().String()}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number", Format: typ.Kind().String()}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: b.schema(typ.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schema(typ.Elem())}
+	case reflect.Struct:
+		if typ.Name() == "" {
+			return b.object(typ)
+		}
+		name, ok := b.names[typ]
+		if !ok {
+			name = b.defName(typ)
+			b.names[typ] = name
+			// reserve the slot before descending so self references resolve
+			b.defs[name] = &Schema{}
+			*b.defs[name] = *b.object(typ)
+		}
+		return &Schema{Ref: "#/$defs/" + name}
+	}
+	// interfaces, and anything encoding/json can't represent, accept any value
+	return &Schema{}
+}
+
+func (b *schemaBuilder) defName(typ reflect.Type) string {
+	name := typ.Name()
+	if _, taken := b.defs[name]; !taken {
+		return name
+	}
+	return strings.ReplaceAll(typ.PkgPath(), "/", ".") + "." + name
+}
+
+func (b *schemaBuilder) object(typ reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	b.fields(typ, s)
+	return s
+}
+
+func (b *schemaBuilder) fields(typ reflect.Type, s *Schema) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := field.Type
+		if field.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.fields(ft, s)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fs := b.schema(ft)
+		if hasOption(opts, "string") && fs.Ref == "" {
+			fs = &Schema{Type: "string", Format: fs.Format}
+		}
+		s.Properties[name] = fs
+		if !hasOption(opts, "omitempty") && !hasOption(opts, "omitzero") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func hasOption(opts, option string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// MissingFields lists the fields of typ that the JSON in data leaves out
+// although SchemaOf marks them required, looking into nested objects and
+// arrays. Names match case-insensitively, as encoding/json does. Values of
+// the wrong JSON type are left for decoding to report.
+func MissingFields(typ reflect.Type, data json.RawMessage) []status.FieldViolation {
+	var violations []status.FieldViolation
+	if len(data) == 0 && typ.Kind() == reflect.Struct {
+		// no args at all miss every required field
+		data = json.RawMessage("{}")
+	}
+	missingFields(typ, data, "", &violations)
+	return violations
+}
+
+func missingFields(typ reflect.Type, data json.RawMessage, path string, violations *[]status.FieldViolation) {
+	typ = indirectType(typ)
+	if len(data) == 0 || string(data) == "null" {
+		return
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		if typ == timeType {
+			return
+		}
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return
+		}
+		missingStructFields(typ, object, path, violations)
+	case reflect.Slice, reflect.Array:
+		if typ == bytesType || typ == rawMessageType {
+			return
+		}
+		var items []json.RawMessage
+		if json.Unmarshal(data, &items) != nil {
+			return
+		}
+		for i, item := range items {
+			missingFields(typ.Elem(), item, path+"["+strconv.Itoa(i)+"]", violations)
+		}
+	case reflect.Map:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			missingFields(typ.Elem(), object[key], path+"["+key+"]", violations)
+		}
+	}
+}
+
+func missingStructFields(typ reflect.Type, object map[string]json.RawMessage, path string, violations *[]status.FieldViolation) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && indirectType(field.Type).Kind() == reflect.Struct {
+			missingStructFields(indirectType(field.Type), object, path, violations)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		value, ok := lookupField(object, name)
+		if !ok {
+			if !hasOption(opts, "omitempty") && !hasOption(opts, "omitzero") {
+				*violations = append(*violations, status.FieldViolation{Field: fieldPath, Description: "is missing"})
+			}
+			continue
+		}
+		missingFields(field.Type, value, fieldPath, violations)
+	}
+}
+
+// lookupField finds name in object, preferring an exact match.
+func lookupField(object map[string]json.RawMessage, name string) (json.RawMessage, bool) {
+	if value, ok := object[name]; ok {
+		return value, true
+	}
+	for key, value := range object {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
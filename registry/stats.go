@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"rpcsimple/metrics"
+	"rpcsimple/status"
+	"sync/atomic"
+	"time"
+)
+
+// MethodStats is a snapshot of the counters of a method. Calls, Successes,
+// Errors, Panics and Latency cover the calls that reached the method;
+// BytesIn, BytesOut and Timeouts are recorded by the server for every
+// request to it.
+type MethodStats struct {
+	Calls     uint64 `json:"calls"`
+	Successes uint64 `json:"successes"`
+	Errors    uint64 `json:"errors"`
+	// ErrorsByCode breaks Errors down by status code.
+	ErrorsByCode map[status.Code]uint64 `json:"errorsByCode,omitempty"`
+	// Timeouts counts the calls answered with DeadlineExceeded while the
+	// method was still running.
+	Timeouts uint64 `json:"timeouts"`
+	// Panics counts the calls whose method panicked, answered as Internal
+	// errors.
+	Panics   uint64       `json:"panics"`
+	InFlight int64        `json:"inFlight"`
+	BytesIn  uint64       `json:"bytesIn"`
+	BytesOut uint64       `json:"bytesOut"`
+	Latency  LatencyStats `json:"latency"`
+}
+
+// LatencyStats estimates latency quantiles from the method's histogram, in
+// nanoseconds when encoded to JSON.
+type LatencyStats struct {
+	Count uint64        `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+}
+
+// errorCodes are the codes errors are counted by; any other code counts as
+// Unknown.
+var errorCodes = [...]status.Code{
+	status.Canceled,
+	status.Unknown,
+	status.InvalidArgument,
+	status.DeadlineExceeded,
+	status.NotFound,
+	status.PermissionDenied,
+	status.ResourceExhausted,
+	status.FailedPrecondition,
+	status.Internal,
+	status.Unavailable,
+	status.Unauthenticated,
+}
+
+var errorCodeIndex = func() map[status.Code]int {
+	index := make(map[status.Code]int, len(errorCodes))
+	for i, code := range errorCodes {
+		index[code] = i
+	}
+	return index
+}()
+
+// methodCounters are the lock-free counters behind MethodStats.
+type methodCounters struct {
+	numCalls     uint64
+	numErrors    uint64
+	successes    uint64
+	errorsByCode [len(errorCodes)]uint64
+	timeouts     uint64
+	panics       uint64
+	inFlight     int64
+	bytesIn      uint64
+	bytesOut     uint64
+	latency      metrics.Histogram
+}
+
+func (c *methodCounters) recordError(code status.Code) {
+	atomic.AddUint64(&c.numErrors, 1)
+	i, ok := errorCodeIndex[code]
+	if !ok {
+		i = errorCodeIndex[status.Unknown]
+	}
+	atomic.AddUint64(&c.errorsByCode[i], 1)
+}
+
+// RecordTransfer adds the sizes of a request to the method and of its
+// response.
+func (m *MethodEntry) RecordTransfer(bytesIn, bytesOut int) {
+	atomic.AddUint64(&m.bytesIn, uint64(bytesIn))
+	atomic.AddUint64(&m.bytesOut, uint64(bytesOut))
+}
+
+// RecordTimeout counts a call given up on while the method was running.
+func (m *MethodEntry) RecordTimeout() {
+	atomic.AddUint64(&m.timeouts, 1)
+}
+
+// Stats returns a snapshot of the method's counters.
+func (m *MethodEntry) Stats() MethodStats {
+	return m.stats(false)
+}
+
+// ResetStats zeroes the method's counters, but for InFlight, returning what
+// they were. Calls counted concurrently show up in either the returned
+// stats or the next ones.
+func (m *MethodEntry) ResetStats() MethodStats {
+	return m.stats(true)
+}
+
+func (m *MethodEntry) stats(reset bool) MethodStats {
+	take := atomic.LoadUint64
+	if reset {
+		take = func(addr *uint64) uint64 { return atomic.SwapUint64(addr, 0) }
+	}
+	stats := MethodStats{
+		Calls:     take(&m.numCalls),
+		Successes: take(&m.successes),
+		Errors:    take(&m.numErrors),
+		Timeouts:  take(&m.timeouts),
+		Panics:    take(&m.panics),
+		InFlight:  atomic.LoadInt64(&m.inFlight),
+		BytesIn:   take(&m.bytesIn),
+		BytesOut:  take(&m.bytesOut),
+	}
+	for i, code := range errorCodes {
+		if n := take(&m.errorsByCode[i]); n > 0 {
+			if stats.ErrorsByCode == nil {
+				stats.ErrorsByCode = make(map[status.Code]uint64)
+			}
+			stats.ErrorsByCode[code] = n
+		}
+	}
+	latency := m.latency.Take(reset)
+	stats.Latency = LatencyStats{
+		Count: latency.Count(),
+		P50:   latency.Quantile(0.5),
+		P90:   latency.Quantile(0.9),
+		P99:   latency.Quantile(0.99),
+	}
+	return stats
+}
+
+// Stats returns the stats of every registered method keyed as Methods does.
+func (registry *Registry) Stats() map[string]MethodStats {
+	return registry.takeStats(false)
+}
+
+// ResetStats zeroes the stats of every registered method, returning what
+// they were.
+func (registry *Registry) ResetStats() map[string]MethodStats {
+	return registry.takeStats(true)
+}
+
+func (registry *Registry) takeStats(reset bool) map[string]MethodStats {
+	methods := registry.Methods()
+	stats := make(map[string]MethodStats, len(methods))
+	for name, m := range methods {
+		stats[name] = m.stats(reset)
+	}
+	return stats
+}
@@ -0,0 +1,320 @@
+package registry
+
+import (
+	"fmt"
+	"reflect"
+	"rpcsimple/status"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Argument fields are validated from their `validate` tag, a comma-separated
+// list of rules:
+//
+//	required   not the zero value, not nil and not empty
+//	omitempty  skip the other rules when the field is the zero value
+//	min=N      numbers at least N, strings, slices and maps at least N long
+//	max=N      numbers at most N, strings, slices and maps at most N long
+//	len=N      strings, slices and maps exactly N long
+//	oneof=a b  strings and numbers equal to one of the space-separated values
+//
+// e.g. `validate:"required,max=100"`. Nested structs, and the structs in
+// slices and maps, are validated too. Lengths of strings count runes.
+
+type rule struct {
+	name  string
+	param string
+	n     float64  // the parameter of min, max and len
+	oneof []string // the values of oneof
+}
+
+type fieldRules struct {
+	index     int
+	name      string // the JSON name
+	embedded  bool   // flattened into the parent like encoding/json does
+	omitempty bool
+	rules     []rule
+}
+
+// validateCache maps struct types to their []fieldRules.
+var validateCache sync.Map
+
+// structRules returns the rules of the fields of typ, a struct type, failing
+// for tags that don't parse or don't fit their field.
+func structRules(typ reflect.Type) ([]fieldRules, error) {
+	if cached, ok := validateCache.Load(typ); ok {
+		return cached.([]fieldRules), nil
+	}
+	var fields []fieldRules
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		embedded := field.Anonymous && name == "" && indirectType(field.Type).Kind() == reflect.Struct
+		if !field.IsExported() && !embedded {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		f := fieldRules{index: i, name: name, embedded: embedded}
+		if validateTag := field.Tag.Get("validate"); validateTag != "" {
+			var err error
+			if f.rules, f.omitempty, err = parseRules(validateTag, field.Type); err != nil {
+				return nil, fmt.Errorf("field %s: %v", field.Name, err)
+			}
+		}
+		fields = append(fields, f)
+	}
+	validateCache.Store(typ, fields)
+	return fields, nil
+}
+
+func parseRules(tag string, typ reflect.Type) ([]rule, bool, error) {
+	var rules []rule
+	omitempty := false
+	kind := indirectType(typ).Kind()
+	for _, part := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(part), "=")
+		r := rule{name: name, param: param}
+		switch name {
+		case "required":
+		case "omitempty":
+			omitempty = true
+			continue
+		case "min", "max", "len":
+			n, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("%s needs a number, got %q", name, param)
+			}
+			if !isNumber(kind) && !hasLength(kind) || name == "len" && !hasLength(kind) {
+				return nil, false, fmt.Errorf("%s doesn't apply to %s", name, typ)
+			}
+			r.n = n
+		case "oneof":
+			r.oneof = strings.Fields(param)
+			if len(r.oneof) == 0 {
+				return nil, false, fmt.Errorf("oneof needs values")
+			}
+			if !isNumber(kind) && kind != reflect.String {
+				return nil, false, fmt.Errorf("oneof doesn't apply to %s", typ)
+			}
+		default:
+			return nil, false, fmt.Errorf("unknown rule %q", name)
+		}
+		rules = append(rules, r)
+	}
+	return rules, omitempty, nil
+}
+
+// checkValidateTags parses the validate tags of typ and of the types it
+// contains, so that a mistake fails registration instead of calls.
+func checkValidateTags(typ reflect.Type, seen map[reflect.Type]bool) error {
+	typ = indirectType(typ)
+	if seen[typ] {
+		return nil
+	}
+	seen[typ] = true
+	switch typ.Kind() {
+	case reflect.Struct:
+		fields, err := structRules(typ)
+		if err != nil {
+			return fmt.Errorf("%s: %v", typ, err)
+		}
+		for _, f := range fields {
+			if err := checkValidateTags(typ.Field(f.index).Type, seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return checkValidateTags(typ.Elem(), seen)
+	}
+	return nil
+}
+
+// Validate checks v against the validate tags of its fields, returning
+// every violation.
+func Validate(v interface{}) []status.FieldViolation {
+	var violations []status.FieldViolation
+	validateValue(reflect.ValueOf(v), "", &violations)
+	return violations
+}
+
+func validateValue(v reflect.Value, path string, violations *[]status.FieldViolation) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		fields, err := structRules(v.Type())
+		if err != nil {
+			// rejected at registration, so only for values validated directly
+			*violations = append(*violations, status.FieldViolation{Field: path, Description: err.Error()})
+			return
+		}
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.embedded {
+				validateValue(fv, path, violations)
+				continue
+			}
+			fieldPath := f.name
+			if path != "" {
+				fieldPath = path + "." + f.name
+			}
+			if description := checkRules(fv, f); description != "" {
+				*violations = append(*violations, status.FieldViolation{Field: fieldPath, Description: description})
+				continue
+			}
+			validateValue(fv, fieldPath, violations)
+		}
+	case reflect.Slice, reflect.Array:
+		if !mayHoldStructs(v.Type().Elem()) {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), path+"["+strconv.Itoa(i)+"]", violations)
+		}
+	case reflect.Map:
+		if !mayHoldStructs(v.Type().Elem()) {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			validateValue(iter.Value(), path+"["+stringKey(iter.Key())+"]", violations)
+		}
+	}
+}
+
+// checkRules returns why fv breaks the rules of f, "" when it doesn't.
+func checkRules(fv reflect.Value, f fieldRules) string {
+	if len(f.rules) == 0 || f.omitempty && isEmpty(fv) {
+		return ""
+	}
+	for _, r := range f.rules {
+		if r.name == "required" {
+			if isEmpty(fv) {
+				return "is required"
+			}
+			continue
+		}
+		v := fv
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				// only required asks for a value
+				return ""
+			}
+			v = v.Elem()
+		}
+		if description := checkRule(v, r); description != "" {
+			return description
+		}
+	}
+	return ""
+}
+
+func checkRule(v reflect.Value, r rule) string {
+	if r.name == "oneof" {
+		s := v.String()
+		switch {
+		case v.CanInt():
+			s = strconv.FormatInt(v.Int(), 10)
+		case v.CanUint():
+			s = strconv.FormatUint(v.Uint(), 10)
+		case v.CanFloat():
+			s = strconv.FormatFloat(v.Float(), 'f', -1, 64)
+		}
+		for _, allowed := range r.oneof {
+			if s == allowed {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(r.oneof, ", ")
+	}
+	param := strconv.FormatFloat(r.n, 'f', -1, 64)
+	if isNumber(v.Kind()) {
+		n := numberOf(v)
+		switch {
+		case r.name == "min" && n < r.n:
+			return "must be at least " + param
+		case r.name == "max" && n > r.n:
+			return "must be at most " + param
+		}
+		return ""
+	}
+	n, unit := float64(v.Len()), "items"
+	if v.Kind() == reflect.String {
+		n, unit = float64(utf8.RuneCountInString(v.String())), "characters"
+	}
+	switch {
+	case r.name == "min" && n < r.n:
+		return "must have at least " + param + " " + unit
+	case r.name == "max" && n > r.n:
+		return "must have at most " + param + " " + unit
+	case r.name == "len" && n != r.n:
+		return "must have exactly " + param + " " + unit
+	}
+	return ""
+}
+
+// isEmpty reports whether v is nil, the zero value, or an empty slice or map.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func indirectType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func hasLength(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
+
+func numberOf(v reflect.Value) float64 {
+	switch {
+	case v.CanInt():
+		return float64(v.Int())
+	case v.CanUint():
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+// mayHoldStructs reports whether values of typ can contain fields to
+// validate, to skip walking slices of plain values.
+func mayHoldStructs(typ reflect.Type) bool {
+	switch indirectType(typ).Kind() {
+	case reflect.Struct, reflect.Interface, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+)
+
+// Several versions of a service can be registered at once, e.g. while
+// callers move from Math v1 to v2. A version is chosen with the
+// "Service@version.Method" form, or with the rpc-version metadata for the
+// plain "Service.Method" form. Callers that name no version get the default
+// one: the one set with SetDefaultVersion, else the service registered
+// without a version, else the version registered first.
+
+// WithVersion registers the service as the given version, e.g. "v2".
+func WithVersion(version string) Option {
+	return func(o *registerOptions) { o.version = version }
+}
+
+// splitVersion splits "Math@v2" into "Math" and "v2".
+func splitVersion(name string) (string, string) {
+	service, version, _ := strings.Cut(name, "@")
+	return service, version
+}
+
+func validVersion(version string) bool {
+	return version != "" && !strings.ContainsAny(version, ".@ \t\n/")
+}
+
+// setVersion sets the version of service from name, "Math@v2", or from
+// WithVersion; both may not differ.
+func (o *registerOptions) setVersion(service *Service) error {
+	name, version := splitVersion(service.name)
+	switch {
+	case version != "" && o.version != "" && version != o.version:
+		return &RegisterError{Service: service.name, Reason: "conflicting version " + o.version}
+	case version == "":
+		version = o.version
+	}
+	if strings.Contains(service.name, "@") || version != "" {
+		if !validVersion(version) {
+			return &RegisterError{Service: service.name, Reason: "invalid version " + version}
+		}
+	}
+	service.name, service.version = name, version
+	return nil
+}
+
+func (service *Service) Version() string {
+	return service.version
+}
+
+// key is the name the service is stored under, "Math@v2" for versions.
+func (service *Service) key() string {
+	if service.version == "" {
+		return service.name
+	}
+	return service.name + "@" + service.version
+}
+
+// SetDefaultVersion makes version the one serving callers of service that
+// name no version. version must be registered.
+func (registry *Registry) SetDefaultVersion(service, version string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.serviceMap[service+"@"+version]; !ok {
+		return errors.New("registry: service not defined: " + service + "@" + version)
+	}
+	if registry.defaults == nil {
+		registry.defaults = make(map[string]string)
+	}
+	registry.defaults[service] = version
+	registry.getLogger().Info("rpc server: default version", "service", service, "version", version)
+	return nil
+}
+
+// DefaultVersion returns the version serving callers of service that name
+// none, "" for the service registered without a version.
+func (registry *Registry) DefaultVersion(service string) (string, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	s, ok := registry.lookupLocked(service, "")
+	if !ok {
+		return "", false
+	}
+	return s.version, true
+}
+
+// lookupLocked finds version of service, the default one when version is "".
+func (registry *Registry) lookupLocked(service, version string) (*Service, bool) {
+	if version != "" {
+		s, ok := registry.serviceMap[service+"@"+version]
+		return s, ok
+	}
+	if version, ok := registry.defaults[service]; ok {
+		if s, ok := registry.serviceMap[service+"@"+version]; ok {
+			return s, true
+		}
+	}
+	if s, ok := registry.serviceMap[service]; ok {
+		return s, true
+	}
+	if version, ok := registry.firstVersions[service]; ok {
+		s, ok := registry.serviceMap[service+"@"+version]
+		return s, ok
+	}
+	return nil, false
+}
+
+// addedLocked numbers service in registration order, unless it takes the
+// place of one already numbered, and remembers the first version of each
+// service, the default when no other is set.
+func (registry *Registry) addedLocked(service *Service) {
+	if service.seq == 0 {
+		registry.seq++
+		service.seq = registry.seq
+	}
+	if service.version == "" {
+		return
+	}
+	if registry.firstVersions == nil {
+		registry.firstVersions = make(map[string]string)
+	}
+	if _, ok := registry.firstVersions[service.name]; !ok {
+		registry.firstVersions[service.name] = service.version
+	}
+}
+
+// removedLocked forgets service as a default, so its callers fall back to
+// another version rather than failing. Call it after deleting service.
+func (registry *Registry) removedLocked(service *Service) {
+	if registry.defaults[service.name] == service.version {
+		delete(registry.defaults, service.name)
+	}
+	if service.version == "" || registry.firstVersions[service.name] != service.version {
+		return
+	}
+	// fall back to the version left that was registered first
+	delete(registry.firstVersions, service.name)
+	var first *Service
+	for _, other := range registry.serviceMap {
+		if other.name != service.name || other.version == "" {
+			continue
+		}
+		if first == nil || other.seq < first.seq {
+			first = other
+		}
+	}
+	if first != nil {
+		registry.firstVersions[service.name] = first.version
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"rpcsimple/codec"
+	"rpcsimple/registry"
+	"rpcsimple/trace"
+	"time"
+)
+
+// AccessLogOptions controls the line logged for every call.
+type AccessLogOptions struct {
+	// Disabled turns access logging off entirely.
+	Disabled bool
+	// SampleRate is the fraction of successful calls logged, e.g. Rate(0.1),
+	// nil for all of them. Failed calls are always logged.
+	SampleRate *float64
+	// MethodSampleRates overrides SampleRate per "Service.Method". As for
+	// SampleRate, 0 means no successful call of the method is logged.
+	MethodSampleRates map[string]float64
+	// LogArgs adds the decoded arguments to the line. Fields tagged
+	// `rpc:"sensitive"` and fields named in RedactFields are redacted.
+	LogArgs      bool
+	RedactFields []string
+}
+
+// Rate returns a pointer to rate, for AccessLogOptions.SampleRate.
+func Rate(rate float64) *float64 {
+	return &rate
+}
+
+// SetLogger replaces the logger the server reports to, slog.Default() by default.
+func (server *Server) SetLogger(logger *slog.Logger) {
+	server.logMu.Lock()
+	defer server.logMu.Unlock()
+	server.logger = logger
+}
+
+func (server *Server) SetAccessLog(options AccessLogOptions) {
+	server.logMu.Lock()
+	defer server.logMu.Unlock()
+	server.accessLog = options
+}
+
+func (server *Server) getLogger() *slog.Logger {
+	server.logMu.RLock()
+	defer server.logMu.RUnlock()
+	if server.logger == nil {
+		return slog.Default()
+	}
+	return server.logger
+}
+
+func (server *Server) getAccessLog() AccessLogOptions {
+	server.logMu.RLock()
+	defer server.logMu.RUnlock()
+	return server.accessLog
+}
+
+func (options *AccessLogOptions) sampled(serviceMethod string, statusCode int) bool {
+	if options.Disabled {
+		return false
+	}
+	if statusCode != http.StatusOK {
+		return true
+	}
+	rate, ok := options.MethodSampleRates[serviceMethod]
+	if !ok {
+		if options.SampleRate == nil {
+			return true
+		}
+		rate = *options.SampleRate
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+func (server *Server) logAccess(ctx context.Context, r *http.Request, request RequestData, response ResponseData, start time.Time) {
+	accessLog := server.getAccessLog()
+	if !accessLog.sampled(request.ctx.ServiceMethod, response.StatusCode) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("method", request.ctx.ServiceMethod),
+		slog.Uint64("seq", request.ctx.Seq),
+		slog.String("peer", r.RemoteAddr),
+		slog.Int("status", response.StatusCode),
+		slog.String("code", string(response.code)),
+		slog.Duration("latency", time.Since(start)),
+		slog.Int("req_bytes", request.size),
+		slog.Int("resp_bytes", len(response.Body)),
+		slog.String("trace_id", traceID(ctx)),
+	}
+	if attempt := request.ctx.Metadata[codec.MetadataAttempt]; attempt != "" {
+		attrs = append(attrs, slog.String("attempt", attempt))
+	}
+	if accessLog.LogArgs && response.argv.IsValid() {
+		attrs = append(attrs, slog.Any("args", registry.Redact(response.argv.Interface(), accessLog.RedactFields...)))
+	}
+	level := slog.LevelInfo
+	if response.StatusCode != http.StatusOK {
+		level = slog.LevelWarn
+	}
+	server.getLogger().LogAttrs(ctx, level, "rpc server: access", attrs...)
+}
+
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID.String()
+}
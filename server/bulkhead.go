@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"rpcsimple/registry"
+	"rpcsimple/status"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limit caps how many calls of a service or method run at once, so that one
+// slow method can't take every worker from the others.
+type Limit struct {
+	// MaxInFlight is the number of calls allowed to run concurrently, 0 means no limit.
+	MaxInFlight int
+	// MaxQueue is the number of calls allowed to wait for a slot; the rest
+	// are rejected straight away.
+	MaxQueue int
+	// QueueTimeout bounds the wait for a slot, 0 waits as long as the call's
+	// context allows.
+	QueueTimeout time.Duration
+}
+
+type BulkheadStats struct {
+	MaxInFlight int    `json:"maxInFlight"`
+	InFlight    int    `json:"inFlight"`
+	Queued      int64  `json:"queued"`
+	Rejected    uint64 `json:"rejected"`
+}
+
+type bulkhead struct {
+	limit    Limit
+	slots    chan struct{}
+	queued   int64
+	rejected uint64
+}
+
+func newBulkhead(limit Limit) *bulkhead {
+	return &bulkhead{limit: limit, slots: make(chan struct{}, limit.MaxInFlight)}
+}
+
+func (b *bulkhead) acquire(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if atomic.AddInt64(&b.queued, 1) > int64(b.limit.MaxQueue) {
+		atomic.AddInt64(&b.queued, -1)
+		atomic.AddUint64(&b.rejected, 1)
+		return status.Errorf(status.ResourceExhausted, "%d calls in flight and %d queued", b.limit.MaxInFlight, b.limit.MaxQueue)
+	}
+	defer atomic.AddInt64(&b.queued, -1)
+	var timeout <-chan time.Time
+	if b.limit.QueueTimeout > 0 {
+		timer := time.NewTimer(b.limit.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		atomic.AddUint64(&b.rejected, 1)
+		return status.Errorf(status.ResourceExhausted, "no slot freed up within %v", b.limit.QueueTimeout)
+	case <-ctx.Done():
+		atomic.AddUint64(&b.rejected, 1)
+		return status.FromContextError(ctx.Err())
+	}
+}
+
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+func (b *bulkhead) stats() BulkheadStats {
+	return BulkheadStats{
+		MaxInFlight: b.limit.MaxInFlight,
+		InFlight:    len(b.slots),
+		Queued:      atomic.LoadInt64(&b.queued),
+		Rejected:    atomic.LoadUint64(&b.rejected),
+	}
+}
+
+// bulkheads holds the limits keyed by service name and by "Service.Method".
+type bulkheads struct {
+	mu      sync.RWMutex
+	service map[string]*bulkhead
+	method  map[string]*bulkhead
+}
+
+func newBulkheads() bulkheads {
+	return bulkheads{service: make(map[string]*bulkhead), method: make(map[string]*bulkhead)}
+}
+
+func setLimit(m map[string]*bulkhead, name string, limit Limit) {
+	if limit.MaxInFlight <= 0 {
+		delete(m, name)
+		return
+	}
+	m[name] = newBulkhead(limit)
+}
+
+// SetServiceLimit caps the calls running across all methods of service.
+// A zero MaxInFlight removes the limit. Calls already holding a slot of a
+// replaced limit keep running outside of the new one.
+func (server *Server) SetServiceLimit(service string, limit Limit) {
+	server.bulkheads.mu.Lock()
+	defer server.bulkheads.mu.Unlock()
+	setLimit(server.bulkheads.service, service, limit)
+}
+
+// SetMethodLimit caps the calls running on one "Service.Method".
+func (server *Server) SetMethodLimit(serviceMethod string, limit Limit) {
+	server.bulkheads.mu.Lock()
+	defer server.bulkheads.mu.Unlock()
+	setLimit(server.bulkheads.method, serviceMethod, limit)
+}
+
+// acquire takes a slot from the service bulkhead, then from the method one.
+// The returned func gives both back.
+func (bs *bulkheads) acquire(ctx context.Context, service, serviceMethod string) (func(), error) {
+	bs.mu.RLock()
+	sb, mb := bs.service[service], bs.method[serviceMethod]
+	bs.mu.RUnlock()
+	if sb != nil {
+		if err := sb.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if mb != nil {
+		if err := mb.acquire(ctx); err != nil {
+			if sb != nil {
+				sb.release()
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		if mb != nil {
+			mb.release()
+		}
+		if sb != nil {
+			sb.release()
+		}
+	}, nil
+}
+
+func (bs *bulkheads) stats() map[string]BulkheadStats {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	stats := make(map[string]BulkheadStats, len(bs.service)+len(bs.method))
+	for name, b := range bs.service {
+		stats[name] = b.stats()
+	}
+	for name, b := range bs.method {
+		stats[name] = b.stats()
+	}
+	return stats
+}
+
+// Stats is a snapshot of the server's runtime state.
+type Stats struct {
+	// Bulkheads maps service names and "Service.Method" names to the
+	// occupancy of their limits.
+	Bulkheads map[string]BulkheadStats `json:"bulkheads"`
+	// Methods maps "Service.Method" names of the user registry to their
+	// counters.
+	Methods map[string]registry.MethodStats `json:"methods"`
+}
+
+func (server *Server) Stats() Stats {
+	return server.stats(false)
+}
+
+// ResetStats zeroes the method counters, returning the stats up to then.
+func (server *Server) ResetStats() Stats {
+	return server.stats(true)
+}
+
+func (server *Server) stats(reset bool) Stats {
+	stats := Stats{Bulkheads: server.bulkheads.stats(), Methods: map[string]registry.MethodStats{}}
+	switch {
+	case server.funcMap == nil:
+	case reset:
+		stats.Methods = server.funcMap.ResetStats()
+	default:
+		stats.Methods = server.funcMap.Stats()
+	}
+	return stats
+}
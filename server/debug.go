@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"rpcsimple/registry"
+	"rpcsimple/status"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxRecentFailures = 50
+
+type activeCall struct {
+	Seq           uint64
+	ServiceMethod string
+	Start         time.Time
+}
+
+type failedCall struct {
+	Time          time.Time
+	ServiceMethod string
+	StatusCode    int
+	Code          status.Code
+	Error         string
+	Duration      time.Duration
+}
+
+// callTracker remembers the calls currently being served and the most recent
+// failures, which is all the debug page needs beyond the registry counters.
+type callTracker struct {
+	mu       sync.Mutex
+	seq      uint64
+	inflight map[uint64]*activeCall
+	failures []failedCall // ring buffer, next points at the oldest entry
+	next     int
+}
+
+func newCallTracker() callTracker {
+	return callTracker{inflight: make(map[uint64]*activeCall)}
+}
+
+func (t *callTracker) begin(serviceMethod string) *activeCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	call := &activeCall{Seq: t.seq, ServiceMethod: serviceMethod, Start: time.Now()}
+	t.inflight[call.Seq] = call
+	return call
+}
+
+func (t *callTracker) end(call *activeCall, response ResponseData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inflight, call.Seq)
+	if response.StatusCode == http.StatusOK {
+		return
+	}
+	failure := failedCall{
+		Time:          call.Start,
+		ServiceMethod: call.ServiceMethod,
+		StatusCode:    response.StatusCode,
+		Code:          response.code,
+		Error:         string(response.Body),
+		Duration:      time.Since(call.Start),
+	}
+	if len(t.failures) < maxRecentFailures {
+		t.failures = append(t.failures, failure)
+		return
+	}
+	t.failures[t.next] = failure
+	t.next = (t.next + 1) % maxRecentFailures
+}
+
+// snapshot returns the in-flight calls oldest first and the failures newest first.
+func (t *callTracker) snapshot() ([]activeCall, []failedCall) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	inflight := make([]activeCall, 0, len(t.inflight))
+	for _, call := range t.inflight {
+		inflight = append(inflight, *call)
+	}
+	sort.Slice(inflight, func(i, j int) bool { return inflight[i].Seq < inflight[j].Seq })
+	failures := make([]failedCall, 0, len(t.failures))
+	for i := len(t.failures) - 1; i >= 0; i-- {
+		failures = append(failures, t.failures[(t.next+i)%len(t.failures)])
+	}
+	return inflight, failures
+}
+
+type debugMethod struct {
+	Service, Method string
+	registry.MethodStats
+	ErrorRate float64
+}
+
+type debugInflight struct {
+	activeCall
+	Elapsed time.Duration
+}
+
+type debugBulkhead struct {
+	Name string
+	BulkheadStats
+}
+
+type debugPage struct {
+	Methods   []debugMethod
+	Bulkheads []debugBulkhead
+	Inflight  []debugInflight
+	Failures  []failedCall
+}
+
+func (server *Server) debugPage() debugPage {
+	var page debugPage
+	for name, stats := range server.funcMap.Stats() {
+		// service names may hold dots themselves
+		dot := strings.LastIndex(name, ".")
+		dm := debugMethod{Service: name[:dot], Method: name[dot+1:], MethodStats: stats}
+		if dm.Calls > 0 {
+			dm.ErrorRate = float64(dm.Errors) / float64(dm.Calls)
+		}
+		page.Methods = append(page.Methods, dm)
+	}
+	sort.Slice(page.Methods, func(i, j int) bool {
+		if page.Methods[i].Service != page.Methods[j].Service {
+			return page.Methods[i].Service < page.Methods[j].Service
+		}
+		return page.Methods[i].Method < page.Methods[j].Method
+	})
+	for name, stats := range server.bulkheads.stats() {
+		page.Bulkheads = append(page.Bulkheads, debugBulkhead{Name: name, BulkheadStats: stats})
+	}
+	sort.Slice(page.Bulkheads, func(i, j int) bool { return page.Bulkheads[i].Name < page.Bulkheads[j].Name })
+	inflight, failures := server.tracker.snapshot()
+	now := time.Now()
+	for _, call := range inflight {
+		page.Inflight = append(page.Inflight, debugInflight{activeCall: call, Elapsed: now.Sub(call.Start)})
+	}
+	page.Failures = failures
+	return page
+}
+
+func (server *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, server.debugPage()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// SetStatsReset lets POST /debug/rpc/stats?reset=true take and reset the
+// stats, e.g. for a scraper that wants deltas. It is off by default as
+// anyone reaching the endpoint could then wipe them.
+func (server *Server) SetStatsReset(enabled bool) {
+	server.updateSettings(func(s *settings) { s.statsReset = enabled })
+}
+
+// handleStats serves Stats as JSON. POST with reset=true zeroes the method
+// counters after taking them, when SetStatsReset allows it.
+func (server *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	var stats Stats
+	switch {
+	case r.Method == http.MethodGet:
+		stats = server.Stats()
+	case r.Method == http.MethodPost && r.URL.Query().Get("reset") == "true":
+		if !server.getSettings().statsReset {
+			http.Error(w, "resetting the stats is disabled, see SetStatsReset", http.StatusForbidden)
+			return
+		}
+		stats = server.ResetStats()
+	default:
+		http.Error(w, "GET the stats, or POST with reset=true to take and reset them", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+}).Parse(`<html>
+<head><title>Services</title></head>
+<body>
+<h1>Services</h1>
+<table border="1" cellpadding="4">
+<tr><th>Service</th><th>Method</th><th>Calls</th><th>In flight</th><th>Errors</th><th>Error rate</th><th>Timeouts</th><th>Panics</th><th>Bytes in</th><th>Bytes out</th><th>p50</th><th>p90</th><th>p99</th></tr>
+{{range .Methods}}<tr><td>{{.Service}}</td><td>{{.Method}}</td><td>{{.Calls}}</td><td>{{.InFlight}}</td><td>{{.Errors}}</td><td>{{percent .ErrorRate}}</td><td>{{.Timeouts}}</td><td>{{.Panics}}</td><td>{{.BytesIn}}</td><td>{{.BytesOut}}</td><td>{{.Latency.P50}}</td><td>{{.Latency.P90}}</td><td>{{.Latency.P99}}</td></tr>
+{{end}}</table>
+{{if .Bulkheads}}<h1>Limits</h1>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Max in flight</th><th>In flight</th><th>Queued</th><th>Rejected</th></tr>
+{{range .Bulkheads}}<tr><td>{{.Name}}</td><td>{{.MaxInFlight}}</td><td>{{.InFlight}}</td><td>{{.Queued}}</td><td>{{.Rejected}}</td></tr>
+{{end}}</table>
+{{end}}<h1>In-flight calls</h1>
+<table border="1" cellpadding="4">
+<tr><th>Seq</th><th>Method</th><th>Started</th><th>Elapsed</th></tr>
+{{range .Inflight}}<tr><td>{{.Seq}}</td><td>{{.ServiceMethod}}</td><td>{{.Start.Format "15:04:05.000"}}</td><td>{{.Elapsed}}</td></tr>
+{{end}}</table>
+<h1>Recent failures</h1>
+<table border="1" cellpadding="4">
+<tr><th>Time</th><th>Method</th><th>Status</th><th>Code</th><th>Duration</th><th>Error</th></tr>
+{{range .Failures}}<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.ServiceMethod}}</td><td>{{.StatusCode}}</td><td>{{.Code}}</td><td>{{.Duration}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>`))
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"rpcsimple/status"
+	"sync"
+	"time"
+)
+
+// IdempotencyKey identifies one logical call: the same key sent by another
+// principal, or for another method, is a different call.
+type IdempotencyKey struct {
+	Principal     string
+	ServiceMethod string
+	Key           string
+}
+
+// IdempotencyStore keeps the outcome of completed idempotent calls so that
+// duplicates can be answered without running the method again.
+type IdempotencyStore interface {
+	Get(key IdempotencyKey) (StoredResponse, bool)
+	Put(key IdempotencyKey, response StoredResponse)
+}
+
+// StoredResponse is the outcome of a call as kept by an IdempotencyStore.
+type StoredResponse struct {
+	StatusCode  int
+	Body        []byte
+	ContentType string
+	Code        status.Code
+}
+
+func storedFrom(response ResponseData) StoredResponse {
+	return StoredResponse{StatusCode: response.StatusCode, Body: response.Body, ContentType: response.ContentType, Code: response.code}
+}
+
+// replay returns the stored outcome as the response to a duplicate.
+func (stored StoredResponse) replay() ResponseData {
+	return ResponseData{StatusCode: stored.StatusCode, Body: stored.Body, ContentType: stored.ContentType, code: stored.Code, replayed: true}
+}
+
+// MemoryIdempotencyStore is an in-process IdempotencyStore holding at most
+// capacity outcomes, each for ttl, evicting the least recently stored first.
+type MemoryIdempotencyStore struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // of *storeEntry, oldest at the back
+	entries  map[IdempotencyKey]*list.Element
+}
+
+type storeEntry struct {
+	key      IdempotencyKey
+	response StoredResponse
+	expires  time.Time
+}
+
+var _ IdempotencyStore = (*MemoryIdempotencyStore)(nil)
+
+func NewMemoryIdempotencyStore(capacity int, ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[IdempotencyKey]*list.Element),
+	}
+}
+
+func (store *MemoryIdempotencyStore) Get(key IdempotencyKey) (StoredResponse, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	elem, ok := store.entries[key]
+	if !ok {
+		return StoredResponse{}, false
+	}
+	stored := elem.Value.(*storeEntry)
+	if time.Now().After(stored.expires) {
+		store.order.Remove(elem)
+		delete(store.entries, key)
+		return StoredResponse{}, false
+	}
+	return stored.response, true
+}
+
+func (store *MemoryIdempotencyStore) Put(key IdempotencyKey, response StoredResponse) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if elem, ok := store.entries[key]; ok {
+		store.order.Remove(elem)
+	}
+	stored := &storeEntry{key: key, response: response, expires: time.Now().Add(store.ttl)}
+	store.entries[key] = store.order.PushFront(stored)
+	for store.order.Len() > store.capacity {
+		oldest := store.order.Back()
+		store.order.Remove(oldest)
+		delete(store.entries, oldest.Value.(*storeEntry).key)
+	}
+}
+
+// idempotentCall is a call in progress that duplicates wait for.
+type idempotentCall struct {
+	done     chan struct{}
+	response ResponseData
+	stored   bool // response was kept in the store
+}
+
+// SetIdempotencyStore replaces the store of idempotent outcomes; nil turns
+// idempotency keys off. New servers keep up to 10000 outcomes for 10 minutes.
+func (server *Server) SetIdempotencyStore(store IdempotencyStore) {
+	server.updateSettings(func(s *settings) { s.idempotency = store })
+}
+
+// PrincipalFunc identifies the caller of r; idempotency keys are scoped to it.
+type PrincipalFunc func(r *http.Request) string
+
+// SetPrincipalFunc replaces the default principal, a hash of the
+// Authorization header.
+func (server *Server) SetPrincipalFunc(principal PrincipalFunc) {
+	server.updateSettings(func(s *settings) { s.principal = principal })
+}
+
+func authorizationPrincipal(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(auth))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReplayedHeader marks responses answered from the idempotency store.
+const ReplayedHeader = "Idempotent-Replayed"
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// callIdempotent runs the call at most once per key: stored outcomes are
+// replayed and duplicates arriving while it runs wait for it to finish.
+func (server *Server) callIdempotent(callCtx context.Context, ctx Context, store IdempotencyStore, key string) ResponseData {
+	k := IdempotencyKey{
+		Principal:     principalFromContext(callCtx),
+		ServiceMethod: ctx.ServiceMethod,
+		Key:           key,
+	}
+	if stored, ok := store.Get(k); ok {
+		return stored.replay()
+	}
+
+	server.idempotentMu.Lock()
+	if call, ok := server.idempotentCalls[k]; ok {
+		server.idempotentMu.Unlock()
+		select {
+		case <-call.done:
+			response := call.response
+			response.replayed = call.stored
+			return response
+		case <-callCtx.Done():
+			return errorResponse(status.FromContextError(callCtx.Err()))
+		}
+	}
+	// the outcome may have been stored between Get and taking the lock
+	if stored, ok := store.Get(k); ok {
+		server.idempotentMu.Unlock()
+		return stored.replay()
+	}
+	call := &idempotentCall{done: make(chan struct{})}
+	server.idempotentCalls[k] = call
+	server.idempotentMu.Unlock()
+
+	response := server.call(callCtx, ctx)
+	if response.final == nil {
+		server.finishIdempotent(store, k, call, response)
+		return response
+	}
+	// the method outlived the call: duplicates keep waiting for it rather
+	// than running it a second time
+	go func() {
+		server.finishIdempotent(store, k, call, <-response.final)
+	}()
+	return response
+}
+
+// finishIdempotent records the outcome of a method that has returned and
+// releases the duplicates waiting for it.
+func (server *Server) finishIdempotent(store IdempotencyStore, k IdempotencyKey, call *idempotentCall, response ResponseData) {
+	// only outcomes of a method that ran to completion are worth replaying
+	if response.code == status.OK || response.appError {
+		store.Put(k, storedFrom(response))
+		call.stored = true
+	}
+	call.response = response
+	server.idempotentMu.Lock()
+	delete(server.idempotentCalls, k)
+	server.idempotentMu.Unlock()
+	close(call.done)
+}
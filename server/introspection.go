@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"rpcsimple/registry"
+)
+
+// RPC is the built-in service every server exposes next to the user registry.
+type RPC struct {
+	server *Server
+}
+
+// Services is the RPC equivalent of GET /services.
+func (rpc *RPC) Services(args struct{}, reply *[]registry.ServiceInfo) error {
+	*reply = rpc.server.services()
+	return nil
+}
+
+func (server *Server) services() []registry.ServiceInfo {
+	return append(server.funcMap.Services(), server.builtin.Services()...)
+}
+
+func (server *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(server.services())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"rpcsimple/registry"
+	"rpcsimple/status"
+	"time"
+)
+
+// DeprecatedHeader carries the notice of deprecated methods, see
+// registry.MethodOptions.Deprecated.
+const DeprecatedHeader = "Rpc-Deprecated"
+
+// ScopeFunc lists the scopes granted to the caller of r, checked against the
+// scopes methods require.
+type ScopeFunc func(r *http.Request) []string
+
+// SetScopeFunc sets how callers' scopes are found, typically from a token the
+// principal func verified too. Without one no scope is granted, so methods
+// requiring scopes can't be called.
+func (server *Server) SetScopeFunc(scopes ScopeFunc) {
+	server.updateSettings(func(s *settings) { s.scopes = scopes })
+}
+
+type scopesKey struct{}
+
+func scopesFromContext(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesKey{}).([]string)
+	return scopes
+}
+
+// applyOptions checks a call against the options of its method and bounds
+// its context by the method's timeouts.
+func (server *Server) applyOptions(callCtx context.Context, ctx Context, mEntry *registry.MethodEntry) (context.Context, context.CancelFunc, error) {
+	opts := mEntry.Options
+	if size := ctx.argsSize(); opts.MaxArgsSize > 0 && size > opts.MaxArgsSize {
+		return nil, nil, status.Errorf(status.ResourceExhausted, "arguments of %d bytes exceed the %d allowed for %s", size, opts.MaxArgsSize, ctx.ServiceMethod)
+	}
+	if missing := missingScope(scopesFromContext(callCtx), opts.Scopes); missing != "" {
+		return nil, nil, status.Errorf(status.PermissionDenied, "%s requires scope %s", ctx.ServiceMethod, missing)
+	}
+	if !mEntry.Allow() {
+		return nil, nil, status.Errorf(status.ResourceExhausted, "%s is limited to %g calls per second", ctx.ServiceMethod, opts.RateLimit)
+	}
+	if opts.Deprecated != "" {
+		if _, logged := server.deprecationLogged.LoadOrStore(mEntry, true); !logged {
+			server.getLogger().Warn("rpc server: deprecated method called", "method", ctx.ServiceMethod, "notice", opts.Deprecated)
+		}
+	}
+
+	deadline, hasDeadline := callCtx.Deadline()
+	timeout := time.Duration(0)
+	switch {
+	case !hasDeadline:
+		timeout = opts.DefaultTimeout
+		if timeout == 0 {
+			timeout = server.getSettings().defaultTimeout
+		}
+		if opts.MaxTimeout > 0 && (timeout == 0 || timeout > opts.MaxTimeout) {
+			timeout = opts.MaxTimeout
+		}
+	case opts.MaxTimeout > 0 && time.Until(deadline) > opts.MaxTimeout:
+		timeout = opts.MaxTimeout
+	}
+	if timeout > 0 {
+		newCtx, cancel := context.WithTimeout(callCtx, timeout)
+		return newCtx, cancel, nil
+	}
+	newCtx, cancel := context.WithCancel(callCtx)
+	return newCtx, cancel, nil
+}
+
+// argsSize is the size of the encoded arguments: Args of the JSON envelope,
+// or the whole body of codec requests, which don't delimit them.
+func (ctx *Context) argsSize() int {
+	if ctx.codec != nil {
+		return ctx.size
+	}
+	return len(ctx.Args)
+}
+
+// missingScope returns the first of required that granted lacks.
+func missingScope(granted, required []string) string {
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return scope
+		}
+	}
+	return ""
+}
+
+// SetDefaultTimeout bounds the calls of methods without a DefaultTimeout of
+// their own when the caller set no deadline, 10s by default; 0 lets them run
+// for as long as they take.
+func (server *Server) SetDefaultTimeout(timeout time.Duration) {
+	server.updateSettings(func(s *settings) { s.defaultTimeout = timeout })
+}
+
+// SetStrictArgs makes every method reject JSON arguments with unknown
+// fields, e.g. misspelled ones, or missing required fields, those without
+// omitempty. Without it only the methods registered with
+// registry.MethodOptions.StrictArgs do, and the others leave such fields
+// zero.
+func (server *Server) SetStrictArgs(strict bool) {
+	server.updateSettings(func(s *settings) { s.strictArgs = strict })
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"reflect"
+	"rpcsimple/codec"
+	"sync"
+	"time"
+)
+
+// maxCachedReplies bounds the reply cache; replies beyond it aren't cached
+// until others expire.
+const maxCachedReplies = 10000
+
+// replyKey identifies the calls answered by the same cached reply.
+type replyKey struct {
+	principal     string
+	serviceMethod string
+	version       string
+	args          string
+}
+
+type cachedReply struct {
+	response ResponseData
+	expires  time.Time
+}
+
+// replyCache keeps the successful replies of read-only methods, see
+// registry.MethodOptions.CacheTTL.
+type replyCache struct {
+	mu      sync.Mutex
+	entries map[replyKey]cachedReply
+}
+
+// replyKeyOf is the key of the call, false for calls that can't be cached:
+// the arguments of codec requests aren't kept once decoded.
+func replyKeyOf(principal string, ctx Context) (replyKey, bool) {
+	if ctx.codec != nil {
+		return replyKey{}, false
+	}
+	return replyKey{
+		principal:     principal,
+		serviceMethod: ctx.ServiceMethod,
+		version:       ctx.Metadata[codec.MetadataVersion],
+		args:          string(ctx.Args),
+	}, true
+}
+
+func (cache *replyCache) get(key replyKey) (ResponseData, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cached, ok := cache.entries[key]
+	if !ok {
+		return ResponseData{}, false
+	}
+	if time.Now().After(cached.expires) {
+		delete(cache.entries, key)
+		return ResponseData{}, false
+	}
+	return cached.response, true
+}
+
+func (cache *replyCache) put(key replyKey, response ResponseData, ttl time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.entries == nil {
+		cache.entries = make(map[replyKey]cachedReply)
+	}
+	response.argv = reflect.Value{} // hits log their own arguments
+	now := time.Now()
+	if len(cache.entries) >= maxCachedReplies {
+		for k, cached := range cache.entries {
+			if now.After(cached.expires) {
+				delete(cache.entries, k)
+			}
+		}
+		if len(cache.entries) >= maxCachedReplies {
+			return
+		}
+	}
+	cache.entries[key] = cachedReply{response: response, expires: now.Add(ttl)}
+}
@@ -1,28 +1,63 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"reflect"
+	"rpcsimple/codec"
 	"rpcsimple/registry"
+	"rpcsimple/status"
+	"rpcsimple/trace"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
 )
 
 type Context struct {
-	ConnectTimeout int // 0 means no limit
+	ConnectTimeout int // seconds, 0 means no limit; superseded by the rpc-timeout-ms metadata
 	HandleTimeout  int
 	ServiceMethod  string
-	Args           map[string]interface{}
+	Seq            uint64
+	Metadata       map[string]string
+	// Args is decoded straight into the argument type of the method
+	Args json.RawMessage
+
+	// set for requests encoded with one of codec.NewCodecFuncMap instead of
+	// the JSON envelope; Args is then read from the codec
+	codecType codec.Type
+	codec     codec.Codec
+	size      int // of the request body
 }
 
 type Server struct {
-	funcMap *registry.Registry
-	pool    *ants.Pool
+	funcMap   *registry.Registry
+	builtin   *registry.Registry
+	pool      *ants.Pool
+	tracker   callTracker
+	bulkheads bulkheads
+
+	logMu     sync.RWMutex // guards logger and accessLog
+	logger    *slog.Logger
+	accessLog AccessLogOptions
+
+	settingsMu sync.RWMutex // guards settings
+	settings   settings
+
+	idempotentMu    sync.Mutex
+	idempotentCalls map[IdempotencyKey]*idempotentCall
+
+	replies           replyCache
+	deprecationLogged sync.Map // of *registry.MethodEntry, warned about once
 }
 
 func NewServer(poolSize int) (*Server, error) {
@@ -30,18 +65,67 @@ func NewServer(poolSize int) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Server{pool: pool}, nil
+	server := &Server{
+		pool:      pool,
+		builtin:   registry.NewRegistry(),
+		tracker:   newCallTracker(),
+		bulkheads: newBulkheads(),
+		settings: settings{
+			defaultTimeout: 10 * time.Second,
+			idempotency:    NewMemoryIdempotencyStore(10000, 10*time.Minute),
+		},
+		idempotentCalls: make(map[IdempotencyKey]*idempotentCall),
+	}
+	if err := server.builtin.Register(&RPC{server: server}); err != nil {
+		return nil, err
+	}
+	return server, nil
 }
 
 var DefaultServer, _ = NewServer(5000)
 
+// settings are the server-wide options of the Set methods, which may be
+// called while the server is serving.
+type settings struct {
+	principal      PrincipalFunc
+	scopes         ScopeFunc
+	strictArgs     bool
+	defaultTimeout time.Duration
+	statsReset     bool
+	idempotency    IdempotencyStore
+	tracer         *trace.Tracer
+}
+
+func (server *Server) getSettings() settings {
+	server.settingsMu.RLock()
+	defer server.settingsMu.RUnlock()
+	return server.settings
+}
+
+func (server *Server) updateSettings(update func(*settings)) {
+	server.settingsMu.Lock()
+	defer server.settingsMu.Unlock()
+	update(&server.settings)
+}
+
+// Handler 返回服务器的全部 HTTP 路由
+func (server *Server) Handler(funcMap *registry.Registry) http.Handler {
+	server.funcMap = funcMap
+	mux := http.NewServeMux()
+	mux.HandleFunc("/call", server.handleRequest)
+	mux.HandleFunc("/services", server.handleServices)
+	mux.HandleFunc("/debug/rpc", server.handleDebug)
+	mux.HandleFunc("/debug/rpc/stats", server.handleStats)
+	return mux
+}
+
 // 启动服务器
 func (server *Server) Start(address string, funcMap *registry.Registry) {
-	server.funcMap = funcMap
-	http.HandleFunc("/call", server.handleRequest)
-	log.Printf("Starting HTTP server on %s\n", address)
-	if err := http.ListenAndServe(address, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	handler := server.Handler(funcMap)
+	server.getLogger().Info("rpc server: starting HTTP server", "address", address)
+	if err := http.ListenAndServe(address, handler); err != nil {
+		server.getLogger().Error("rpc server: failed to start server", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -50,13 +134,26 @@ func Start(address string, funcMap *registry.Registry) {
 }
 
 type RequestData struct {
-	ctx Context
-	err error
+	ctx  Context
+	size int
+	err  error
 }
 
 type ResponseData struct {
-	StatusCode int
-	Body       []byte
+	StatusCode  int
+	Body        []byte
+	ContentType string        // application/json when empty
+	argv        reflect.Value // decoded arguments, kept for the access log
+	code        status.Code
+	appError    bool // the error was returned by the method itself
+	replayed    bool // answered from the idempotency store
+	deprecated  string
+	// safeToRepeat tells the client it may retry the method, see
+	// codec.MetadataSafeToRepeat
+	safeToRepeat bool
+	// final delivers the outcome of a method still running when the call
+	// gave up on it
+	final <-chan ResponseData
 }
 
 func (server *Server) handleRequestWithPool(w http.ResponseWriter, r *http.Request) {
@@ -65,34 +162,45 @@ func (server *Server) handleRequestWithPool(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	start := time.Now()
 	requestChan := make(chan RequestData)
 	err := server.pool.Submit(func() {
 		server.readRequest(r, requestChan)
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to submit request to pool: %v", err), http.StatusInternalServerError)
+		response := errorResponse(status.Errorf(status.Unavailable, "failed to submit request to pool: %v", err))
+		writeResponse(w, response)
+		server.logAccess(extractTrace(r, nil), r, RequestData{}, response, start)
 		return
 	}
 
 	result := <-requestChan
 	if result.err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read or parse request body: %v", result.err), http.StatusBadRequest)
+		response := errorResponse(status.Errorf(status.InvalidArgument, "failed to read or parse request body: %v", result.err))
+		writeResponse(w, response)
+		server.logAccess(extractTrace(r, nil), r, result, response, start)
 		return
 	}
 
+	callCtx, cancel := server.requestContext(r, result)
+	defer cancel()
+	callCtx, span := server.startSpan(callCtx, r, result)
 	responseChan := make(chan ResponseData)
 	err = server.pool.Submit(func() {
-		server.handle(result.ctx, responseChan)
+		server.handle(callCtx, result.ctx, responseChan)
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to submit request to pool: %v", err), http.StatusInternalServerError)
+		response := errorResponse(status.Errorf(status.Unavailable, "failed to submit request to pool: %v", err))
+		writeResponse(w, response)
+		endSpan(span, response)
+		server.logAccess(callCtx, r, result, response, start)
 		return
 	}
 
 	response := <-responseChan
-	w.WriteHeader(response.StatusCode)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response.Body)
+	endSpan(span, response)
+	writeResponse(w, response)
+	server.logAccess(callCtx, r, result, response, start)
 }
 
 func (server *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
@@ -101,109 +209,309 @@ func (server *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start := time.Now()
 	requestChan := make(chan RequestData)
 	go server.readRequest(r, requestChan)
 
 	result := <-requestChan
 	if result.err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read or parse request body: %v", result.err), http.StatusBadRequest)
+		response := errorResponse(status.Errorf(status.InvalidArgument, "failed to read or parse request body: %v", result.err))
+		writeResponse(w, response)
+		server.logAccess(extractTrace(r, nil), r, result, response, start)
 		return
 	}
 
+	callCtx, cancel := server.requestContext(r, result)
+	defer cancel()
+	callCtx, span := server.startSpan(callCtx, r, result)
 	responseChan := make(chan ResponseData)
-	go server.handle(result.ctx, responseChan)
+	go server.handle(callCtx, result.ctx, responseChan)
 
 	response := <-responseChan
+	endSpan(span, response)
+	writeResponse(w, response)
+	server.logAccess(callCtx, r, result, response, start)
+}
+
+func writeResponse(w http.ResponseWriter, response ResponseData) {
+	contentType := response.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if response.replayed {
+		w.Header().Set(ReplayedHeader, "true")
+	}
+	if response.deprecated != "" {
+		w.Header().Set(DeprecatedHeader, response.deprecated)
+	}
+	if response.safeToRepeat {
+		w.Header().Set(codec.MetadataSafeToRepeat, "true")
+	}
 	w.WriteHeader(response.StatusCode)
-	w.Header().Set("Content-Type", "application/json")
 	w.Write(response.Body)
 }
 
 func (server *Server) readRequest(r *http.Request, requestChan chan<- RequestData) {
 	var ctx Context
 	body, err := io.ReadAll(r.Body)
+	ctx.size = len(body)
 	if err != nil {
-		requestChan <- RequestData{ctx: ctx, err: err}
+		requestChan <- RequestData{ctx: ctx, size: len(body), err: err}
 		return
 	}
 
-	if err := json.Unmarshal(body, &ctx); err != nil {
-		requestChan <- RequestData{ctx: ctx, err: err}
-		return
+	if newCodec, ok := codec.NewCodecFuncMap[codec.Type(r.Header.Get("Content-Type"))]; ok {
+		ctx.codecType = codec.Type(r.Header.Get("Content-Type"))
+		ctx.codec = newCodec(codec.Conn(bytes.NewReader(body), io.Discard))
+		var header codec.Header
+		if err := ctx.codec.ReadHeader(&header); err != nil {
+			requestChan <- RequestData{ctx: ctx, size: len(body), err: err}
+			return
+		}
+		ctx.ServiceMethod, ctx.Seq, ctx.Metadata = header.ServiceMethod, header.Seq, header.Metadata
+	} else {
+		if err := json.Unmarshal(body, &ctx); err != nil {
+			requestChan <- RequestData{ctx: ctx, size: len(body), err: err}
+			return
+		}
+	}
+	for _, key := range []string{codec.MetadataIdempotencyKey, codec.MetadataTimeout, codec.MetadataAttempt, codec.MetadataVersion} {
+		if value := r.Header.Get(key); value != "" {
+			if ctx.Metadata == nil {
+				ctx.Metadata = make(map[string]string)
+			}
+			ctx.Metadata[key] = value
+		}
 	}
-	requestChan <- RequestData{ctx: ctx, err: nil}
+	requestChan <- RequestData{ctx: ctx, size: len(body), err: nil}
 }
 
-func (server *Server) handle(ctx Context, responseChan chan<- ResponseData) {
-	service, mEntry, err := server.funcMap.FindService(ctx.ServiceMethod)
-	if err != nil {
-		responseChan <- ResponseData{
-			StatusCode: http.StatusBadRequest,
-			Body:       []byte(fmt.Sprintf("Service method %s not found: %v", ctx.ServiceMethod, err)),
-		}
-		return
+// requestContext is the context calls run under: the caller's trace context,
+// principal, scopes and deadline on top of the HTTP request's context.
+func (server *Server) requestContext(r *http.Request, request RequestData) (context.Context, context.CancelFunc) {
+	ctx := extractTrace(r, request.ctx.Metadata)
+	settings := server.getSettings()
+	principal := settings.principal
+	if principal == nil {
+		principal = authorizationPrincipal
+	}
+	ctx = context.WithValue(ctx, principalKey{}, principal(r))
+	if settings.scopes != nil {
+		ctx = context.WithValue(ctx, scopesKey{}, settings.scopes(r))
+	}
+	if timeout := request.ctx.timeout(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
 	}
+	return context.WithCancel(ctx)
+}
 
-	argv := mEntry.NewArgv()
-	replyv := mEntry.NewReplyv()
+// timeout is how long the caller is willing to wait, 0 for no limit.
+func (ctx *Context) timeout() time.Duration {
+	if ms, err := strconv.ParseInt(ctx.Metadata[codec.MetadataTimeout], 10, 64); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return time.Duration(ctx.ConnectTimeout) * time.Second
+}
+
+func (server *Server) handle(callCtx context.Context, ctx Context, responseChan chan<- ResponseData) {
+	call := server.tracker.begin(ctx.ServiceMethod)
+	var response ResponseData
+	store := server.getSettings().idempotency
+	if key := ctx.Metadata[codec.MetadataIdempotencyKey]; key != "" && store != nil {
+		response = server.callIdempotent(callCtx, ctx, store, key)
+	} else {
+		response = server.call(callCtx, ctx)
+	}
+	server.tracker.end(call, response)
+	responseChan <- response
+}
 
-	argBytes, err := json.Marshal(ctx.Args)
+func (server *Server) call(callCtx context.Context, ctx Context) ResponseData {
+	service, mEntry, err := server.findService(ctx.ServiceMethod, ctx.Metadata[codec.MetadataVersion])
 	if err != nil {
-		responseChan <- ResponseData{
-			StatusCode: http.StatusBadRequest,
-			Body:       []byte(fmt.Sprintf("Failed to marshal arguments: %v", err)),
-		}
-		return
+		return errorResponse(status.Errorf(status.NotFound, "service method %s not found: %v", ctx.ServiceMethod, err))
 	}
+	response := server.callMethod(callCtx, ctx, service, mEntry)
+	response.deprecated = mEntry.Options.Deprecated
+	response.safeToRepeat = mEntry.Options.SafeToRepeat()
+	mEntry.RecordTransfer(ctx.size, len(response.Body))
+	return response
+}
 
-	if argv.Kind() == reflect.Ptr {
-		argv = argv.Elem()
+func (server *Server) callMethod(callCtx context.Context, ctx Context, service *registry.Service, mEntry *registry.MethodEntry) ResponseData {
+	callCtx, cancel, err := server.applyOptions(callCtx, ctx, mEntry)
+	if err != nil {
+		return errorResponse(status.Convert(err))
 	}
+	defer cancel()
+
+	argv := mEntry.NewArgv()
+	replyv := mEntry.NewReplyv()
 
-	if err := json.Unmarshal(argBytes, argv.Addr().Interface()); err != nil {
-		responseChan <- ResponseData{
-			StatusCode: http.StatusBadRequest,
-			Body:       []byte(fmt.Sprintf("Failed to unmarshal arguments: %v", err)),
+	// decode into the args, or into what they point at for pointer args
+	argp := argv
+	if argv.Kind() != reflect.Ptr {
+		argp = argv.Addr()
+	}
+	if err := ctx.decodeArgs(argp.Interface(), server.getSettings().strictArgs || mEntry.Options.StrictArgs); err != nil {
+		return errorResponse(status.Convert(err))
+	}
+	if violations := registry.Validate(argp.Interface()); len(violations) > 0 {
+		response := errorResponse(invalidArguments(violations))
+		response.argv = argv
+		return response
+	}
+	cacheKey, cacheable := replyKeyOf(principalFromContext(callCtx), ctx)
+	cacheable = cacheable && mEntry.Options.CacheTTL > 0
+	if cacheable {
+		if response, ok := server.replies.get(cacheKey); ok {
+			response.argv = argv
+			return response
 		}
-		return
 	}
 
-	callDone := make(chan struct{})
-	var callErr error
+	release, err := server.bulkheads.acquire(callCtx, service.Name(), ctx.ServiceMethod)
+	if err != nil {
+		response := errorResponse(status.Convert(err))
+		response.argv = argv
+		return response
+	}
+
+	// buffered so the method can hand over its outcome after a timeout
+	callDone := make(chan ResponseData, 1)
 
 	go func() {
-		callErr = service.Call(mEntry, argv, replyv)
-		close(callDone)
+		callErr := service.CallContext(callCtx, mEntry, argv, replyv)
+		// the slot is held until the method returns, even past a timeout
+		release()
+		callDone <- ctx.methodResponse(argv, replyv, callErr)
 	}()
 
 	select {
-	case <-callDone:
-		if callErr != nil {
-			responseChan <- ResponseData{
-				StatusCode: http.StatusInternalServerError,
-				Body:       []byte(fmt.Sprintf("Service call failed: %v", callErr)),
-			}
-			return
+	case response := <-callDone:
+		if cacheable && response.code == status.OK {
+			server.replies.put(cacheKey, response, mEntry.Options.CacheTTL)
 		}
-		respMap := map[string]interface{}{
-			"result": replyv.Interface(),
+		return response
+	case <-callCtx.Done():
+		response := errorResponse(status.FromContextError(callCtx.Err()))
+		if response.code == status.DeadlineExceeded {
+			mEntry.RecordTimeout()
 		}
-		respBytes, err := json.Marshal(respMap)
-		if err != nil {
-			responseChan <- ResponseData{
-				StatusCode: http.StatusInternalServerError,
-				Body:       []byte(fmt.Sprintf("Failed to marshal response: %v", err)),
-			}
-			return
+		response.argv = argv
+		response.final = callDone
+		return response
+	}
+}
+
+// methodResponse is the response to a method that returned callErr.
+func (ctx *Context) methodResponse(argv, replyv reflect.Value, callErr error) ResponseData {
+	if callErr != nil {
+		response := errorResponse(status.Convert(callErr))
+		response.argv = argv
+		response.appError = true
+		return response
+	}
+	response, err := ctx.encodeReply(replyv.Interface())
+	if err != nil {
+		return errorResponse(status.Errorf(status.Internal, "failed to marshal response: %v", err))
+	}
+	response.argv = argv
+	return response
+}
+
+// decodeArgs decodes the arguments into args, a pointer. strict applies to
+// the JSON envelope only, the other codecs carry typed arguments.
+func (ctx *Context) decodeArgs(args interface{}, strict bool) error {
+	if ctx.codec != nil {
+		if err := ctx.codec.ReadBody(args); err != nil {
+			return status.Errorf(status.InvalidArgument, "failed to decode arguments: %v", err)
+		}
+		return nil
+	}
+	if len(ctx.Args) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(ctx.Args))
+		if strict {
+			dec.DisallowUnknownFields()
 		}
-		responseChan <- ResponseData{
-			StatusCode: http.StatusOK,
-			Body:       respBytes,
+		if err := dec.Decode(args); err != nil {
+			return argsError(err)
 		}
-	case <-time.After(time.Duration(ctx.ConnectTimeout) * time.Second):
-		responseChan <- ResponseData{
-			StatusCode: http.StatusRequestTimeout,
-			Body:       []byte("Service call timeout"),
+	}
+	if strict {
+		if missing := registry.MissingFields(reflect.TypeOf(args).Elem(), ctx.Args); len(missing) > 0 {
+			return invalidArguments(missing)
 		}
 	}
+	return nil
+}
+
+// argsError turns a JSON decoding error into InvalidArgument, naming the
+// field at fault when there is one.
+func argsError(err error) *status.Error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return invalidArguments([]status.FieldViolation{{
+			Field:       typeErr.Field,
+			Description: "expected " + typeErr.Type.String() + ", got " + typeErr.Value,
+		}})
+	}
+	// encoding/json has no error type for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, _ = strconv.Unquote(field)
+		return invalidArguments([]status.FieldViolation{{Field: field, Description: "unknown field"}})
+	}
+	return status.Errorf(status.InvalidArgument, "failed to decode arguments: %v", err)
+}
+
+// invalidArguments reports the violations of the validate tags of the
+// arguments, the first one in the message.
+func invalidArguments(violations []status.FieldViolation) *status.Error {
+	message := fmt.Sprintf("invalid argument %s: %s", violations[0].Field, violations[0].Description)
+	if len(violations) > 1 {
+		message += fmt.Sprintf(" (and %d more)", len(violations)-1)
+	}
+	err := status.New(status.InvalidArgument, message)
+	err.Details = &status.BadRequest{FieldViolations: violations}
+	return err
+}
+
+// encodeReply answers in the codec the request came in, {"result": reply}
+// for the JSON envelope.
+func (ctx *Context) encodeReply(reply interface{}) (ResponseData, error) {
+	if ctx.codec != nil {
+		var buf bytes.Buffer
+		header := &codec.Header{ServiceMethod: ctx.ServiceMethod, Seq: ctx.Seq}
+		if err := codec.NewCodecFuncMap[ctx.codecType](codec.Conn(nil, &buf)).Write(header, reply); err != nil {
+			return ResponseData{}, err
+		}
+		return ResponseData{StatusCode: http.StatusOK, Body: buf.Bytes(), ContentType: string(ctx.codecType), code: status.OK}, nil
+	}
+	body, err := json.Marshal(map[string]interface{}{"result": reply})
+	if err != nil {
+		return ResponseData{}, err
+	}
+	return ResponseData{StatusCode: http.StatusOK, Body: body, code: status.OK}, nil
+}
+
+// errorResponse encodes err as {"error": {"code": ..., "message": ...}} sent
+// with the HTTP status matching its code, as the status package documents.
+func errorResponse(err *status.Error) ResponseData {
+	body, _ := json.Marshal(map[string]*status.Error{"error": err})
+	return ResponseData{StatusCode: err.Code.HTTPStatus(), Body: body, code: err.Code}
+}
+
+// findService looks the method up in the user registry first, so built-in
+// services never shadow user ones. version is the one the caller asked for
+// in its metadata, if any.
+func (server *Server) findService(serviceMethod, version string) (*registry.Service, *registry.MethodEntry, error) {
+	service, mEntry, err := server.funcMap.FindVersion(serviceMethod, version)
+	if err == nil {
+		return service, mEntry, nil
+	}
+	if service, mEntry, builtinErr := server.builtin.FindService(serviceMethod); builtinErr == nil {
+		return service, mEntry, nil
+	}
+	return nil, nil, err
 }
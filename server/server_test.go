@@ -0,0 +1,713 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"rpcsimple/client"
+	"rpcsimple/codec"
+	"rpcsimple/registry"
+	"rpcsimple/status"
+	"rpcsimple/trace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Math struct{}
+
+type Args struct {
+	A, B int
+}
+
+func (m *Math) Add(args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Math{}) == nil, "failed to register Math")
+	ts := httptest.NewServer(server.Handler(r))
+	t.Cleanup(ts.Close)
+	return server, ts
+}
+
+func TestServer_Services(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/services")
+	_assert(err == nil, "GET /services failed: %v", err)
+	defer resp.Body.Close()
+	var infos []registry.ServiceInfo
+	_assert(json.NewDecoder(resp.Body).Decode(&infos) == nil, "failed to decode /services")
+	_assert(len(infos) == 2 && infos[0].Name == "Math" && infos[1].Name == "RPC", "wrong services %v", infos)
+
+	resp, err = http.Post(ts.URL+"/call", "application/json", strings.NewReader(`{"ServiceMethod":"RPC.Services","ConnectTimeout":1}`))
+	_assert(err == nil, "POST /call failed: %v", err)
+	defer resp.Body.Close()
+	var body struct{ Result []registry.ServiceInfo }
+	_assert(json.NewDecoder(resp.Body).Decode(&body) == nil, "failed to decode RPC.Services")
+	_assert(len(body.Result) == 2 && body.Result[0].Methods[0].Name == "Add", "wrong RPC.Services reply %v", body.Result)
+}
+
+func TestServer_Debug(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp, err := http.Post(ts.URL+"/call", "application/json", strings.NewReader(`{"ServiceMethod":"Math.Add","ConnectTimeout":1,"Args":{"A":1,"B":2}}`))
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "Math.Add failed: %v", err)
+	resp.Body.Close()
+	resp, err = http.Post(ts.URL+"/call", "application/json", strings.NewReader(`{"ServiceMethod":"Math.Sub","ConnectTimeout":1}`))
+	_assert(err == nil && resp.StatusCode == http.StatusNotFound, "Math.Sub should not be found: %v", err)
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/debug/rpc")
+	_assert(err == nil, "GET /debug/rpc failed: %v", err)
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	_assert(strings.Contains(string(page), "<td>Math</td><td>Add</td><td>1</td><td>0</td>"), "Math.Add stats missing:\n%s", page)
+	_assert(strings.Contains(string(page), "<td>Math.Sub</td><td>404</td><td>NotFound</td>"), "Math.Sub failure missing:\n%s", page)
+}
+
+type Secret struct {
+	A, B     int
+	Password string `rpc:"sensitive"`
+}
+
+func (m *Math) Login(args Secret, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	server, ts := newTestServer(t)
+	var buf bytes.Buffer
+	server.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	server.SetAccessLog(AccessLogOptions{LogArgs: true, MethodSampleRates: map[string]float64{"Math.Add": 0}})
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/call", strings.NewReader(`{"ServiceMethod":"Math.Login","Seq":7,"ConnectTimeout":1,"Args":{"A":1,"Password":"hunter2"}}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "Math.Login failed: %v", err)
+	resp.Body.Close()
+	resp, err = http.Post(ts.URL+"/call", "application/json", strings.NewReader(`{"ServiceMethod":"Math.Add","ConnectTimeout":1}`))
+	_assert(err == nil, "Math.Add failed: %v", err)
+	resp.Body.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	_assert(len(lines) == 1, "expect 1 access log line, but got %d:\n%s", len(lines), buf.String())
+	var entry map[string]interface{}
+	_assert(json.Unmarshal([]byte(lines[0]), &entry) == nil, "access log is not JSON")
+	_assert(entry["method"] == "Math.Login" && entry["seq"] == 7.0 && entry["status"] == 200.0, "wrong access log %v", entry)
+	_assert(entry["trace_id"] == "4bf92f3577b34da6a3ce929d0e0e4736", "wrong trace id %v", entry["trace_id"])
+	args := entry["args"].(map[string]interface{})
+	_assert(args["Password"] == registry.Redacted && args["A"] == 1.0, "args not redacted %v", args)
+}
+
+func TestServer_AccessLogPoolRejection(t *testing.T) {
+	server, err := NewServer(1)
+	_assert(err == nil, "failed to create server: %v", err)
+	var buf bytes.Buffer
+	server.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	server.pool.Release()
+
+	w := httptest.NewRecorder()
+	server.handleRequestWithPool(w, httptest.NewRequest(http.MethodPost, "/call", strings.NewReader(`{"ServiceMethod":"Math.Add"}`)))
+	_assert(w.Code == http.StatusServiceUnavailable, "a closed pool should reject the call, got %d", w.Code)
+	var entry map[string]interface{}
+	_assert(json.Unmarshal(buf.Bytes(), &entry) == nil && entry["status"] == 503.0, "the rejection should be logged, got %s", buf.String())
+}
+
+func TestAccessLogOptions_Sampled(t *testing.T) {
+	all := AccessLogOptions{}
+	none := AccessLogOptions{SampleRate: Rate(0), MethodSampleRates: map[string]float64{"Math.Add": 1}}
+	_assert(all.sampled("Math.Add", http.StatusOK), "without a rate every call should be logged")
+	_assert(!none.sampled("Math.Sub", http.StatusOK), "a rate of 0 should log no successful call")
+	_assert(none.sampled("Math.Sub", http.StatusNotFound), "failed calls should always be logged")
+	_assert(none.sampled("Math.Add", http.StatusOK), "the method rate should override")
+}
+
+type Chain struct {
+	client *client.Client
+}
+
+func (c *Chain) Forward(ctx context.Context, args Args, reply *int) error {
+	return c.client.CallContext(ctx, "Math.Add", map[string]interface{}{"A": args.A, "B": args.B}, reply)
+}
+
+func TestServer_Tracing(t *testing.T) {
+	exporter := trace.NewInMemoryExporter()
+	tracer := trace.NewTracer(exporter)
+	server, ts := newTestServer(t)
+	server.SetTracer(tracer)
+
+	chainServer, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	chainServer.SetTracer(tracer)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Chain{client: client.NewClient(ts.URL + "/call")}) == nil, "failed to register Chain")
+	chainTS := httptest.NewServer(chainServer.Handler(r))
+	defer chainTS.Close()
+
+	c := client.NewClient(chainTS.URL+"/call", client.WithTracer(tracer))
+	var reply int
+	err = c.Call("Chain.Forward", map[string]interface{}{"A": 1, "B": 2}, &reply)
+	_assert(err == nil && reply == 3, "wrong result %v: %v", reply, err)
+
+	// Math.Add, Chain.Forward, then the outer client; the inner client has no tracer
+	spans := exporter.Spans()
+	_assert(len(spans) == 3, "expect 3 spans, but got %d", len(spans))
+	_assert(spans[0].Name == "Math.Add" && spans[1].Name == "Chain.Forward" && spans[2].Kind == trace.KindClient, "wrong spans %+v", spans)
+	for _, span := range spans {
+		_assert(span.TraceID == spans[2].TraceID, "span %s left the trace", span.Name)
+	}
+	_assert(spans[0].ParentSpanID == spans[1].SpanID, "Math.Add should continue Chain.Forward")
+	_assert(spans[1].ParentSpanID == spans[2].SpanID, "Chain.Forward should continue the client span")
+}
+
+type Counter struct {
+	mu      sync.Mutex
+	n       int
+	started chan struct{} // signalled as calls begin, when not nil
+	release chan struct{}
+}
+
+func (c *Counter) Incr(args Args, reply *int) error {
+	if c.started != nil {
+		c.started <- struct{}{}
+	}
+	if c.release != nil {
+		<-c.release
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += args.A
+	*reply = c.n
+	return nil
+}
+
+func TestServer_Idempotency(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	counter := &Counter{release: make(chan struct{})}
+	r := registry.NewRegistry()
+	_assert(r.Register(counter) == nil, "failed to register Counter")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+
+	ctx := client.WithIdempotencyKey(context.Background(), "order-1")
+	var wg sync.WaitGroup
+	results := make([]int, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := client.NewClient(ts.URL + "/call")
+			_assert(c.CallContext(ctx, "Counter.Incr", map[string]interface{}{"A": 1}, &results[i]) == nil, "Counter.Incr failed")
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(counter.release)
+	wg.Wait()
+	for _, result := range results {
+		_assert(result == 1, "duplicates should share the first outcome, got %v", results)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/call", strings.NewReader(`{"ServiceMethod":"Counter.Incr","ConnectTimeout":1,"Args":{"A":1}}`))
+	req.Header.Set("Idempotency-Key", "order-1")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil && resp.Header.Get(ReplayedHeader) == "true", "stored outcome should be replayed: %v", err)
+	resp.Body.Close()
+
+	// another principal owns another key space
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/call", strings.NewReader(`{"ServiceMethod":"Counter.Incr","ConnectTimeout":1,"Args":{"A":1}}`))
+	req.Header.Set("Idempotency-Key", "order-1")
+	req.Header.Set("Authorization", "Bearer other")
+	resp, err = http.DefaultClient.Do(req)
+	_assert(err == nil && resp.Header.Get(ReplayedHeader) == "", "other principal should not be replayed: %v", err)
+	resp.Body.Close()
+	_assert(counter.n == 2, "Counter.Incr should run twice, but ran %d times", counter.n)
+}
+
+func TestServer_IdempotencyTimeout(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	counter := &Counter{release: make(chan struct{})}
+	r := registry.NewRegistry()
+	_assert(r.Register(counter) == nil, "failed to register Counter")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+
+	post := func(timeout string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/call", strings.NewReader(`{"ServiceMethod":"Counter.Incr","Args":{"A":1}}`))
+		req.Header.Set("Idempotency-Key", "order-2")
+		if timeout != "" {
+			req.Header.Set(codec.MetadataTimeout, timeout)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil, "request failed: %v", err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := post("50")
+	_assert(resp.StatusCode == status.DeadlineExceeded.HTTPStatus(), "expect DeadlineExceeded, but got %d", resp.StatusCode)
+
+	// the method is still running: a retry waits for it instead of running it again
+	retried := make(chan *http.Response)
+	go func() { retried <- post("") }()
+	time.Sleep(50 * time.Millisecond)
+	close(counter.release)
+	resp = <-retried
+	_assert(resp.StatusCode == http.StatusOK && resp.Header.Get(ReplayedHeader) == "true", "retry should get the stored outcome, got %d", resp.StatusCode)
+	_assert(counter.n == 1, "Counter.Incr should run once, but ran %d times", counter.n)
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	store := NewMemoryIdempotencyStore(2, 50*time.Millisecond)
+	for i, key := range []string{"a", "b", "c"} {
+		store.Put(IdempotencyKey{Key: key}, StoredResponse{StatusCode: http.StatusOK, Body: []byte{byte(i)}, Code: status.OK})
+	}
+	_, ok := store.Get(IdempotencyKey{Key: "a"})
+	_assert(!ok, "oldest outcome should be evicted")
+	response, ok := store.Get(IdempotencyKey{Key: "c"})
+	_assert(ok && response.Body[0] == 2, "newest outcome should be kept")
+	time.Sleep(60 * time.Millisecond)
+	_, ok = store.Get(IdempotencyKey{Key: "c"})
+	_assert(!ok, "outcome should expire after the ttl")
+}
+
+func TestServer_Bulkhead(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	counter := &Counter{started: make(chan struct{}, 2), release: make(chan struct{})}
+	r := registry.NewRegistry()
+	_assert(r.Register(counter) == nil, "failed to register Counter")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	server.SetMethodLimit("Counter.Incr", Limit{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 10 * time.Second})
+
+	errs := make(chan error, 3)
+	call := func() {
+		c := client.NewClient(ts.URL + "/call")
+		errs <- c.Call("Counter.Incr", map[string]interface{}{"A": 1}, nil)
+	}
+	// one call runs, one waits in the queue and the third is turned away
+	go call()
+	<-counter.started
+	go call()
+	_assert(waitFor(func() bool { return server.Stats().Bulkheads["Counter.Incr"].Queued == 1 }), "second call should be queued")
+	go call()
+	err = <-errs
+	_assert(status.CodeOf(err) == status.ResourceExhausted, "expect ResourceExhausted, but got %v", err)
+	stats := server.Stats().Bulkheads["Counter.Incr"]
+	_assert(stats == BulkheadStats{MaxInFlight: 1, InFlight: 1, Queued: 1, Rejected: 1}, "wrong stats %+v", stats)
+
+	close(counter.release)
+	_assert(<-errs == nil && <-errs == nil, "admitted calls should succeed")
+	_assert(server.Stats().Bulkheads["Counter.Incr"].InFlight == 0, "slots should be released")
+}
+
+// waitFor polls cond for up to a few seconds.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+type Big struct{}
+
+type Int64Args struct {
+	N int64
+}
+
+func (b *Big) Echo(args Int64Args, reply *int64) error {
+	*reply = args.N
+	return nil
+}
+
+func (b *Big) Any(args Int64Args, reply *interface{}) error {
+	*reply = args.N
+	return nil
+}
+
+func TestServer_TypedInvoke(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Big{}) == nil, "failed to register Big")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	c := client.NewClient(ts.URL + "/call")
+
+	const n = int64(1<<62 + 1) // not representable as float64
+	echo, err := client.Invoke[Int64Args, int64](context.Background(), c, "Big.Echo", Int64Args{N: n})
+	_assert(err == nil && echo == n, "Big.Echo lost precision: %d: %v", echo, err)
+	anything, err := client.Invoke[Int64Args, interface{}](context.Background(), c, "Big.Any", Int64Args{N: n})
+	_assert(err == nil && anything == json.Number("4611686018427387905"), "Big.Any should decode to json.Number, got %#v: %v", anything, err)
+}
+
+type Clock struct {
+	client *client.Client
+}
+
+// Remaining reports the milliseconds left before the handler's deadline,
+// or forwards the question to the next hop when A is set.
+func (c *Clock) Remaining(ctx context.Context, args Args, reply *int64) error {
+	if args.A > 0 {
+		time.Sleep(20 * time.Millisecond)
+		return c.client.CallContext(ctx, "Clock.Remaining", Args{}, reply)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return status.New(status.FailedPrecondition, "no deadline")
+	}
+	*reply = time.Until(deadline).Milliseconds()
+	return nil
+}
+
+func (c *Clock) Sleep(ctx context.Context, args Args, reply *int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestServer_DeadlinePropagation(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	clock := &Clock{}
+	r := registry.NewRegistry()
+	_assert(r.Register(clock) == nil, "failed to register Clock")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	clock.client = client.NewClient(ts.URL + "/call")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var remaining int64
+	err = clock.client.CallContext(ctx, "Clock.Remaining", Args{A: 1}, &remaining)
+	_assert(err == nil, "Clock.Remaining failed: %v", err)
+	_assert(remaining > 0 && remaining <= 480, "nested call should inherit the shrinking budget, got %dms", remaining)
+
+	err = clock.client.CallContext(context.Background(), "Clock.Remaining", Args{}, &remaining)
+	_assert(err == nil && remaining > 9000 && remaining <= 10000, "calls without a deadline should get the default 10s, got %dms: %v", remaining, err)
+	server.SetDefaultTimeout(0)
+	err = clock.client.CallContext(context.Background(), "Clock.Remaining", Args{}, &remaining)
+	_assert(status.CodeOf(err) == status.FailedPrecondition, "no deadline should be set without a default, got %v", err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = clock.client.CallContext(ctx, "Clock.Sleep", Args{}, nil)
+	_assert(status.CodeOf(err) == status.DeadlineExceeded, "expect DeadlineExceeded, but got %v", err)
+	_assert(time.Since(start) < time.Second, "call should stop at the deadline")
+}
+
+func TestServer_Codecs(t *testing.T) {
+	_, ts := newTestServer(t)
+	for _, codecType := range []codec.Type{codec.GobType, codec.HttpType} {
+		c := client.NewClient(ts.URL+"/call", client.WithCodec(codecType))
+		sum, err := client.Invoke[Args, int](context.Background(), c, "Math.Add", Args{A: 1, B: 2})
+		_assert(err == nil && sum == 3, "%s: wrong sum %d: %v", codecType, sum, err)
+		_, err = client.Invoke[Args, int](context.Background(), c, "Math.Sub", Args{})
+		_assert(status.CodeOf(err) == status.NotFound, "%s: expect NotFound, but got %v", codecType, err)
+	}
+}
+
+type Vector struct{}
+
+type Text struct{ S string }
+
+func (v *Vector) Scale(args *Args, reply *Args) error {
+	*reply = Args{A: args.A * 2, B: args.B * 2}
+	return nil
+}
+
+func TestServer_Funcs(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Vector{}) == nil, "failed to register Vector")
+	_assert(registry.RegisterTyped(r, "Strings.Upper", func(ctx context.Context, args Text) (string, error) {
+		return strings.ToUpper(args.S), nil
+	}) == nil, "failed to register Strings.Upper")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	c := client.NewClient(ts.URL + "/call")
+
+	upper, err := client.Invoke[Text, string](context.Background(), c, "Strings.Upper", Text{S: "hello"})
+	_assert(err == nil && upper == "HELLO", "Strings.Upper returned %q: %v", upper, err)
+	scaled, err := client.Invoke[Args, Args](context.Background(), c, "Vector.Scale", Args{A: 1, B: 2})
+	_assert(err == nil && scaled == Args{A: 2, B: 4}, "pointer args should work, got %v: %v", scaled, err)
+}
+
+func TestServer_MethodOptions(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	server.SetScopeFunc(func(r *http.Request) []string { return strings.Fields(r.Header.Get("X-Scopes")) })
+	r := registry.NewRegistry()
+	_assert(r.Register(&Clock{},
+		registry.WithOptions(registry.MethodOptions{MaxTimeout: 200 * time.Millisecond}),
+		registry.WithMethodOptions("Sleep", registry.MethodOptions{DefaultTimeout: 50 * time.Millisecond}),
+	) == nil, "failed to register Clock")
+	_assert(r.Register(&Math{}, registry.WithMethodOptions("Add", registry.MethodOptions{
+		MaxArgsSize: 40, // less than the whole request, which isn't limited
+		Scopes:      []string{"math"},
+		RateLimit:   1,
+		Deprecated:  "use Math.Sum",
+	})) == nil, "failed to register Math")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	c := client.NewClient(ts.URL + "/call")
+
+	start := time.Now()
+	err = c.Call("Clock.Sleep", Args{}, nil)
+	_assert(status.CodeOf(err) == status.DeadlineExceeded && time.Since(start) < time.Second,
+		"the default timeout should stop the call, got %v", err)
+	var remaining int64
+	err = c.Call("Clock.Remaining", Args{}, &remaining, client.CallTimeout(time.Minute))
+	_assert(err == nil && remaining <= 200, "the max timeout should cap the caller's, got %dms: %v", remaining, err)
+
+	post := func(args string, scopes string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/call", strings.NewReader(`{"ServiceMethod":"Math.Add","Args":`+args+`}`))
+		req.Header.Set("X-Scopes", scopes)
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil, "request failed: %v", err)
+		resp.Body.Close()
+		return resp
+	}
+	_assert(post(`{"A":1,"B":2}`, "").StatusCode == status.PermissionDenied.HTTPStatus(), "calls without the scope should be denied")
+	_assert(post(`{"A":1,"B":2,"Pad":"`+strings.Repeat("x", 100)+`"}`, "math").StatusCode == status.ResourceExhausted.HTTPStatus(),
+		"oversized args should be rejected")
+	resp := post(`{"A":1,"B":2}`, "read math")
+	_assert(resp.StatusCode == http.StatusOK && resp.Header.Get(DeprecatedHeader) == "use Math.Sum",
+		"the call should succeed with a deprecation notice, got %d %q", resp.StatusCode, resp.Header.Get(DeprecatedHeader))
+	_assert(post(`{"A":1,"B":2}`, "math").StatusCode == status.ResourceExhausted.HTTPStatus(), "the rate limit should apply")
+
+	var services []registry.ServiceInfo
+	_assert(c.Call("RPC.Services", struct{}{}, &services) == nil, "RPC.Services failed")
+	_assert(services[1].Name == "Math" && services[1].Methods[0].Options.Deprecated == "use Math.Sum",
+		"options should be introspectable, got %+v", services[1])
+}
+
+func TestServer_ReplyCache(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	var calls int32
+	r := registry.NewRegistry()
+	_assert(r.RegisterFunc("Catalog.Price", func(ctx context.Context, args Args) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		return args.A * 100, nil
+	}, registry.WithOptions(registry.MethodOptions{ReadOnly: true, CacheTTL: time.Minute})) == nil, "failed to register Catalog.Price")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	c := client.NewClient(ts.URL + "/call")
+
+	var price int
+	for i := 0; i < 3; i++ {
+		err = c.Call("Catalog.Price", Args{A: 2}, &price)
+		_assert(err == nil && price == 200, "Catalog.Price failed, got %d: %v", price, err)
+	}
+	err = c.Call("Catalog.Price", Args{A: 3}, &price)
+	_assert(err == nil && price == 300, "other arguments should get their own reply, got %d: %v", price, err)
+	_assert(atomic.LoadInt32(&calls) == 2, "repeated calls should be answered from the cache, but ran %d times", calls)
+
+	resp, err := http.Post(ts.URL+"/call", "application/json", strings.NewReader(`{"ServiceMethod":"Catalog.Price","Args":{"A":2}}`))
+	_assert(err == nil, "request failed: %v", err)
+	resp.Body.Close()
+	_assert(resp.Header.Get(codec.MetadataSafeToRepeat) == "true", "read-only methods should be marked safe to repeat")
+}
+
+type MathV2 struct{}
+
+type Terms struct{ Terms []int }
+
+func (m *MathV2) Add(args Terms, reply *int) error {
+	for _, term := range args.Terms {
+		*reply += term
+	}
+	return nil
+}
+
+func TestServer_Versions(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Math{}) == nil, "failed to register Math")
+	_assert(r.RegisterName("Math", &MathV2{}, registry.WithVersion("v2")) == nil, "failed to register Math v2")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	c := client.NewClient(ts.URL + "/call")
+
+	var sum int
+	_assert(c.Call("Math.Add", Args{A: 1, B: 2}, &sum) == nil && sum == 3, "unversioned callers should get v1, got %d", sum)
+	_assert(c.Call("Math@v2.Add", Terms{Terms: []int{1, 2, 3}}, &sum) == nil && sum == 6, "Math@v2.Add returned %d", sum)
+	sum = 0
+	err = c.Call("Math.Add", Terms{Terms: []int{4, 5}}, &sum, client.CallVersion("v2"))
+	_assert(err == nil && sum == 9, "the version metadata should select v2, got %d: %v", sum, err)
+	err = c.Call("Math.Add", Args{}, &sum, client.CallVersion("v3"))
+	_assert(status.CodeOf(err) == status.NotFound, "expect NotFound for an unknown version, but got %v", err)
+
+	var services []registry.ServiceInfo
+	_assert(c.Call("RPC.Services", struct{}{}, &services) == nil, "RPC.Services failed")
+	_assert(services[0].Version == "" && services[0].Default && services[0].NumCalls == 1, "wrong v1 info %+v", services[0])
+	_assert(services[1].Version == "v2" && services[1].NumCalls == 2, "wrong v2 info %+v", services[1])
+}
+
+type Shop struct{}
+
+type OrderArgs struct {
+	Name     string `json:"name" validate:"required"`
+	Quantity int    `json:"quantity" validate:"min=1,max=100"`
+}
+
+func (s *Shop) Order(args OrderArgs, reply *int) error {
+	*reply = args.Quantity
+	return nil
+}
+
+func TestServer_Validation(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Shop{}) == nil, "failed to register Shop")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+
+	for _, codecType := range []codec.Type{"", codec.GobType} {
+		var opts []client.Option
+		if codecType != "" {
+			opts = append(opts, client.WithCodec(codecType))
+		}
+		c := client.NewClient(ts.URL+"/call", opts...)
+		var n int
+		_assert(c.Call("Shop.Order", OrderArgs{Name: "tea", Quantity: 3}, &n) == nil && n == 3, "%s: valid order failed", codecType)
+		err = c.Call("Shop.Order", OrderArgs{Quantity: 101}, &n)
+		_assert(status.CodeOf(err) == status.InvalidArgument, "%s: expect InvalidArgument, but got %v", codecType, err)
+		violations := status.FieldViolations(err)
+		_assert(len(violations) == 2 && violations[0] == status.FieldViolation{Field: "name", Description: "is required"} &&
+			violations[1].Field == "quantity", "%s: wrong violations %+v", codecType, violations)
+	}
+}
+
+func TestServer_Stats(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Clock{}, registry.WithMethodOptions("Sleep", registry.MethodOptions{DefaultTimeout: 20 * time.Millisecond})) == nil,
+		"failed to register Clock")
+	_assert(r.Register(&Math{}) == nil, "failed to register Math")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+	c := client.NewClient(ts.URL + "/call")
+
+	var sum int
+	_assert(c.Call("Math.Add", Args{A: 1, B: 2}, &sum) == nil, "Math.Add failed")
+	err = c.Call("Clock.Sleep", Args{}, nil)
+	_assert(status.CodeOf(err) == status.DeadlineExceeded, "expect DeadlineExceeded, but got %v", err)
+
+	stats := server.Stats().Methods
+	_assert(stats["Math.Add"].Successes == 1 && stats["Math.Add"].BytesIn > 0 && stats["Math.Add"].BytesOut > 0,
+		"wrong Math.Add stats %+v", stats["Math.Add"])
+	_assert(stats["Clock.Sleep"].Timeouts == 1, "wrong Clock.Sleep stats %+v", stats["Clock.Sleep"])
+
+	resp, err := http.Post(ts.URL+"/debug/rpc/stats?reset=true", "", nil)
+	_assert(err == nil && resp.StatusCode == http.StatusForbidden, "reset should be disabled by default: %v", err)
+	resp.Body.Close()
+	server.SetStatsReset(true)
+	resp, err = http.Post(ts.URL+"/debug/rpc/stats?reset=true", "", nil)
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "failed to reset stats: %v", err)
+	var taken Stats
+	_assert(json.NewDecoder(resp.Body).Decode(&taken) == nil, "failed to decode stats")
+	resp.Body.Close()
+	_assert(taken.Methods["Math.Add"].Calls == 1, "reset should return the stats so far, got %+v", taken.Methods)
+	_assert(server.Stats().Methods["Math.Add"].Calls == 0, "stats should be reset")
+}
+
+type Point struct {
+	X, Y int
+	Tag  string `json:"tag,omitempty"`
+}
+
+type Shape struct {
+	Name   string  `json:"name"`
+	Points []Point `json:"points"`
+}
+
+func (s *Shape) Count(args Shape, reply *int) error {
+	*reply = len(args.Points)
+	return nil
+}
+
+func TestServer_StrictArgs(t *testing.T) {
+	server, err := NewServer(10)
+	_assert(err == nil, "failed to create server: %v", err)
+	r := registry.NewRegistry()
+	_assert(r.Register(&Math{}) == nil, "failed to register Math")
+	_assert(r.Register(&Shape{}, registry.WithOptions(registry.MethodOptions{StrictArgs: true})) == nil, "failed to register Shape")
+	_assert(registry.RegisterTyped(r, "Strings.Upper", func(ctx context.Context, s string) (string, error) {
+		return strings.ToUpper(s), nil
+	}) == nil, "failed to register Strings.Upper")
+	ts := httptest.NewServer(server.Handler(r))
+	defer ts.Close()
+
+	post := func(body string) (int, error) {
+		resp, err := http.Post(ts.URL+"/call", "application/json", strings.NewReader(body))
+		_assert(err == nil, "request failed: %v", err)
+		defer resp.Body.Close()
+		var result struct {
+			Result int           `json:"result"`
+			Error  *status.Error `json:"error"`
+		}
+		_assert(json.NewDecoder(resp.Body).Decode(&result) == nil, "failed to decode response")
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		return result.Result, nil
+	}
+
+	sum, err := post(`{"ServiceMethod":"Math.Add","Args":{"A":1,"Bb":2}}`)
+	_assert(err == nil && sum == 1, "lenient methods should ignore unknown fields, got %d: %v", sum, err)
+	_, err = post(`{"ServiceMethod":"Math.Add","Args":{"A":1,"B":"2"}}`)
+	violations := status.FieldViolations(err)
+	_assert(len(violations) == 1 && violations[0] == status.FieldViolation{Field: "B", Description: "expected int, got string"},
+		"type mismatches should name the field, got %v", err)
+
+	n, err := post(`{"ServiceMethod":"Shape.Count","Args":{"name":"line","points":[{"X":1,"Y":2},{"X":3,"Y":4,"tag":"end"}]}}`)
+	_assert(err == nil && n == 2, "strict call failed: %v", err)
+	_, err = post(`{"ServiceMethod":"Shape.Count","Args":{"name":"line","points":[],"colour":"red"}}`)
+	violations = status.FieldViolations(err)
+	_assert(status.CodeOf(err) == status.InvalidArgument && len(violations) == 1 && violations[0].Field == "colour",
+		"unknown fields should be rejected, got %v", err)
+	_, err = post(`{"ServiceMethod":"Shape.Count","Args":{"points":[{"X":1}]}}`)
+	violations = status.FieldViolations(err)
+	_assert(len(violations) == 2 && violations[0].Field == "name" && violations[1].Field == "points[0].Y",
+		"missing fields should be rejected, got %v", violations)
+
+	server.SetStrictArgs(true)
+	_, err = post(`{"ServiceMethod":"Math.Add","Args":{"A":1,"Bb":2}}`)
+	_assert(status.CodeOf(err) == status.InvalidArgument, "SetStrictArgs should apply to every method, got %v", err)
+
+	c := client.NewClient(ts.URL + "/call")
+	upper, err := client.Invoke[string, string](context.Background(), c, "Strings.Upper", "hello")
+	_assert(err == nil && upper == "HELLO", "scalar args should work, got %q: %v", upper, err)
+}
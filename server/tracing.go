@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"rpcsimple/trace"
+)
+
+// SetTracer records a server span around every call. Without a tracer the
+// incoming trace context is still handed to handlers, so their outgoing calls
+// stay in the caller's trace.
+func (server *Server) SetTracer(tracer *trace.Tracer) {
+	server.updateSettings(func(s *settings) { s.tracer = tracer })
+}
+
+// extractTrace reads the caller's span context from the HTTP headers, falling
+// back to the metadata carried in the request body.
+func extractTrace(r *http.Request, metadata map[string]string) context.Context {
+	ctx := r.Context()
+	if sc, ok := trace.Extract(r.Header.Get); ok {
+		return trace.ContextWithSpanContext(ctx, sc)
+	}
+	if sc, ok := trace.Extract(func(key string) string { return metadata[key] }); ok {
+		return trace.ContextWithSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+func (server *Server) startSpan(ctx context.Context, r *http.Request, request RequestData) (context.Context, *trace.Span) {
+	tracer := server.getSettings().tracer
+	if tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := tracer.Start(ctx, request.ctx.ServiceMethod, trace.KindServer)
+	span.SetAttribute("rpc.method", request.ctx.ServiceMethod)
+	span.SetAttribute("net.peer", r.RemoteAddr)
+	return ctx, span
+}
+
+func endSpan(span *trace.Span, response ResponseData) {
+	if span == nil {
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		span.SetError(&statusError{code: response.StatusCode, body: response.Body})
+	}
+	span.End()
+}
+
+type statusError struct {
+	code int
+	body []byte
+}
+
+func (e *statusError) Error() string {
+	return http.StatusText(e.code) + ": " + string(e.body)
+}
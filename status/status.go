@@ -0,0 +1,176 @@
+// Package status defines the codes calls fail with and how they travel.
+//
+// A failed call is answered with the HTTP status of its code and a JSON body
+//
+//	{"error": {"code": "NotFound", "message": "...", "details": ...}}
+//
+// where details is optional, e.g. a BadRequest for invalid arguments. A
+// successful one is answered with 200 and {"result": ...}. The HTTP statuses
+// are those of Code.HTTPStatus: 400 InvalidArgument, 401 Unauthenticated,
+// 403 PermissionDenied, 404 NotFound, 408 DeadlineExceeded, 412
+// FailedPrecondition, 429 ResourceExhausted, 499 Canceled, 503 Unavailable
+// and 500 for Internal and Unknown. Errors used to be sent as plain text with
+// 400 or 500 only; clients read bodies that aren't JSON, e.g. from proxies,
+// with FromHTTPStatus.
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Code classifies why a call failed, independently of the transport.
+type Code string
+
+const (
+	OK                 Code = "OK"
+	Canceled           Code = "Canceled"
+	Unknown            Code = "Unknown"
+	InvalidArgument    Code = "InvalidArgument"
+	DeadlineExceeded   Code = "DeadlineExceeded"
+	NotFound           Code = "NotFound"
+	PermissionDenied   Code = "PermissionDenied"
+	ResourceExhausted  Code = "ResourceExhausted"
+	FailedPrecondition Code = "FailedPrecondition"
+	Internal           Code = "Internal"
+	Unavailable        Code = "Unavailable"
+	Unauthenticated    Code = "Unauthenticated"
+)
+
+var httpStatus = map[Code]int{
+	OK:                 http.StatusOK,
+	Canceled:           499, // client closed request
+	Unknown:            http.StatusInternalServerError,
+	InvalidArgument:    http.StatusBadRequest,
+	DeadlineExceeded:   http.StatusRequestTimeout,
+	NotFound:           http.StatusNotFound,
+	PermissionDenied:   http.StatusForbidden,
+	ResourceExhausted:  http.StatusTooManyRequests,
+	FailedPrecondition: http.StatusPreconditionFailed,
+	Internal:           http.StatusInternalServerError,
+	Unavailable:        http.StatusServiceUnavailable,
+	Unauthenticated:    http.StatusUnauthorized,
+}
+
+// HTTPStatus is the HTTP status code responses with code are sent with.
+func (code Code) HTTPStatus() int {
+	if status, ok := httpStatus[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// FromHTTPStatus guesses the code of a response that carries no error body,
+// e.g. one produced by a proxy.
+func FromHTTPStatus(status int) Code {
+	switch status {
+	case http.StatusOK:
+		return OK
+	case http.StatusBadRequest:
+		return InvalidArgument
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return DeadlineExceeded
+	case http.StatusTooManyRequests:
+		return ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return Unavailable
+	}
+	return Unknown
+}
+
+// Error is an error with a Code. Handlers return it to choose the code
+// callers see; any other error is reported as Unknown.
+type Error struct {
+	Code    Code        `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", e.Code, e.Message)
+}
+
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Convert returns err as an *Error, wrapping foreign errors as Unknown.
+func Convert(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: Unknown, Message: err.Error()}
+}
+
+// CodeOf returns the code of err: OK for nil, Unknown for foreign errors.
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return Convert(err).Code
+}
+
+// FromContextError converts context.Canceled and context.DeadlineExceeded.
+func FromContextError(err error) *Error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return New(Canceled, err.Error())
+	}
+	return Convert(err)
+}
+
+// FieldViolation is one reason an argument is invalid. Field is the path of
+// the argument field in its JSON form, e.g. "items[2].name".
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// BadRequest is the Details of InvalidArgument errors caused by invalid
+// argument fields.
+type BadRequest struct {
+	FieldViolations []FieldViolation `json:"fieldViolations"`
+}
+
+// FieldViolations returns the field violations err carries, whether it was
+// created here or decoded from a response.
+func FieldViolations(err error) []FieldViolation {
+	e := Convert(err)
+	if e == nil || e.Details == nil {
+		return nil
+	}
+	if details, ok := e.Details.(*BadRequest); ok {
+		return details.FieldViolations
+	}
+	// decoded from JSON as plain maps
+	b, err := json.Marshal(e.Details)
+	if err != nil {
+		return nil
+	}
+	var details BadRequest
+	if json.Unmarshal(b, &details) != nil {
+		return nil
+	}
+	return details.FieldViolations
+}
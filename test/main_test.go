@@ -0,0 +1,40 @@
+package test
+
+import (
+	"log"
+	"net"
+	"os"
+	"rpcsimple/registry"
+	"rpcsimple/server"
+	"testing"
+	"time"
+)
+
+type Math struct{}
+
+type Args struct {
+	A, B int
+}
+
+func (m *Math) Add(args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+// TestMain serves Math on the address the stress tests dial.
+func TestMain(m *testing.M) {
+	r := registry.NewRegistry()
+	if err := r.Register(&Math{}); err != nil {
+		log.Fatal(err)
+	}
+	go server.Start("127.0.0.1:9999", r)
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:9999")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	os.Exit(m.Run())
+}
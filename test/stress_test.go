@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"log"
 	"math/rand"
 	"rpcsimple/client"
@@ -39,28 +40,24 @@ func TestStress(t *testing.T) {
 
 	sem := make(chan struct{}, numGoroutines)
 	defer close(sem)
-	client := client.NewClient("http://127.0.0.1:9999/call")
+	c := client.NewClient("http://127.0.0.1:9999/call")
 
 	for i := 0; i < numRequests; i++ {
 		sem <- struct{}{}
 		go func(i int) {
 			defer func() { <-sem }()
-			args := make(map[string]interface{})
 			x := rand.Intn(1000)
 			y := rand.Intn(1000)
 
-			args["A"] = x
-			args["B"] = y
-			response := client.Call("Math.Add", args)
+			args := ArgsPayload{A: x, B: y}
+			result, err := client.Invoke[ArgsPayload, int](context.Background(), c, "Math.Add", args)
+			if err != nil {
+				t.Errorf("Call failed: %v", err)
+			}
 
 			expected := x + y
-			// Type assertion to ensure correct type comparison
-			if result, ok := response.Result.(float64); ok {
-				if int(result) != expected {
-					t.Errorf("Unexpected result: got %v, want %v", result, expected)
-				}
-			} else {
-				t.Errorf("Unexpected result type: got %T, want float64", response.Result)
+			if result != expected {
+				t.Errorf("Unexpected result: got %v, want %v", result, expected)
 			}
 
 			wg.Done()
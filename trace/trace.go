@@ -0,0 +1,247 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// W3C trace-context header names, also used as codec metadata keys.
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+
+func (id SpanID) MarshalText() ([]byte, error) {
+	if !id.IsValid() {
+		return []byte{}, nil
+	}
+	return []byte(id.String()), nil
+}
+
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+var ErrInvalidTraceparent = errors.New("trace: invalid traceparent")
+
+// Parse builds a SpanContext from traceparent and tracestate header values.
+func Parse(traceparent, tracestate string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+	sc.TraceState = tracestate
+	return sc, nil
+}
+
+// Inject writes sc through set under the W3C header names.
+func Inject(sc SpanContext, set func(key, value string)) {
+	if !sc.IsValid() {
+		return
+	}
+	set(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		set(TracestateHeader, sc.TraceState)
+	}
+}
+
+// Extract reads a SpanContext through get, the inverse of Inject.
+func Extract(get func(key string) string) (SpanContext, bool) {
+	sc, err := Parse(get(TraceparentHeader), get(TracestateHeader))
+	return sc, err == nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx whose spans and outgoing calls
+// continue sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx, if any.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+const (
+	KindServer = "server"
+	KindClient = "client"
+)
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	TraceID      TraceID           `json:"trace_id"`
+	SpanID       SpanID            `json:"span_id"`
+	ParentSpanID SpanID            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// MarshalJSON leaves parent_span_id out of root spans, which omitempty
+// doesn't do for arrays.
+func (data SpanData) MarshalJSON() ([]byte, error) {
+	type spanData SpanData
+	out := struct {
+		spanData
+		ParentSpanID *SpanID `json:"parent_span_id,omitempty"`
+	}{spanData: spanData(data)}
+	if data.ParentSpanID.IsValid() {
+		out.ParentSpanID = &data.ParentSpanID
+	}
+	return json.Marshal(out)
+}
+
+// Span records one operation until End is called.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ctx    SpanContext
+	ended  bool
+}
+
+func (span *Span) SpanContext() SpanContext {
+	return span.ctx
+}
+
+func (span *Span) SetAttribute(key, value string) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	if span.data.Attributes == nil {
+		span.data.Attributes = make(map[string]string)
+	}
+	span.data.Attributes[key] = value
+}
+
+func (span *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.data.Error = err.Error()
+}
+
+// End finishes the span and exports it. Only the first call has an effect.
+func (span *Span) End() {
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.data.End = time.Now()
+	data := span.data
+	span.mu.Unlock()
+	if span.tracer != nil && span.tracer.exporter != nil && span.ctx.Flags&FlagSampled != 0 {
+		_ = span.tracer.exporter.Export(&data)
+	}
+}
+
+// Tracer starts spans and hands them to its exporter once they end.
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start begins a span that is a child of the span context in ctx, or the root
+// of a new sampled trace. The returned context carries the new span.
+// A nil Tracer still propagates the parent so traces survive untraced hops.
+func (tracer *Tracer) Start(ctx context.Context, name, kind string) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, Flags: parent.Flags, TraceState: parent.TraceState}
+	if !parent.IsValid() {
+		sc = SpanContext{TraceID: newTraceID(), Flags: FlagSampled}
+	}
+	sc.SpanID = newSpanID()
+	span := &Span{
+		tracer: tracer,
+		ctx:    sc,
+		data: SpanData{
+			TraceID:      sc.TraceID,
+			SpanID:       sc.SpanID,
+			ParentSpanID: parent.SpanID,
+			Name:         name,
+			Kind:         kind,
+			Start:        time.Now(),
+		},
+	}
+	return ContextWithSpanContext(ctx, sc), span
+}
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
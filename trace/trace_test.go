@@ -0,0 +1,60 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestParse(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := Parse(header, "congo=t61rcWkgMzE")
+	_assert(err == nil && sc.IsValid(), "failed to parse %s: %v", header, err)
+	_assert(sc.Traceparent() == header, "round trip gave %s", sc.Traceparent())
+	_assert(sc.TraceState == "congo=t61rcWkgMzE" && sc.Flags == FlagSampled, "wrong span context %+v", sc)
+
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"} {
+		_, err := Parse(bad, "")
+		_assert(err == ErrInvalidTraceparent, "%q should be invalid", bad)
+	}
+}
+
+func TestTracer_Start(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer(exporter)
+	ctx, root := tracer.Start(context.Background(), "root", KindClient)
+	_, child := tracer.Start(ctx, "child", KindServer)
+	child.End()
+	root.End()
+	root.End()
+
+	spans := exporter.Spans()
+	_assert(len(spans) == 2, "expect 2 spans, but got %d", len(spans))
+	_assert(spans[0].TraceID == spans[1].TraceID, "spans should share a trace")
+	_assert(spans[0].ParentSpanID == spans[1].SpanID && !spans[1].ParentSpanID.IsValid(), "child should point at root")
+}
+
+func TestSpanData_MarshalJSON(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	ctx, root := NewTracer(exporter).Start(context.Background(), "root", KindClient)
+	_, child := NewTracer(exporter).Start(ctx, "child", KindServer)
+	child.End()
+	root.End()
+
+	spans := exporter.Spans()
+	var fields map[string]interface{}
+	body, err := json.Marshal(spans[1])
+	_assert(err == nil && json.Unmarshal(body, &fields) == nil, "failed to marshal the root span: %v", err)
+	_, ok := fields["parent_span_id"]
+	_assert(!ok && fields["span_id"] == spans[1].SpanID.String(), "root span should have no parent, got %s", body)
+	body, _ = json.Marshal(spans[0])
+	_assert(json.Unmarshal(body, &fields) == nil && fields["parent_span_id"] == spans[1].SpanID.String(), "child should point at root, got %s", body)
+}